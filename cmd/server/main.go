@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
 	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/signaler"
@@ -28,17 +32,104 @@ func main() {
 		stunPortTCP = 3479
 	}
 	realm := cfg.Section("turn").Key("realm").String()
+	turnCert := cfg.Section("turn").Key("cert").MustString(cfg.Section("general").Key("cert").String())
+	turnKey := cfg.Section("turn").Key("key").MustString(cfg.Section("general").Key("key").String())
 
 	turnConfig := turn.DefaultConfig()
 	turnConfig.PublicIP = publicIP
+	turnConfig.PublicIPv6 = cfg.Section("turn").Key("public_ip_v6").String()
 	turnConfig.Port = stunPort
 	turnConfig.PortTCP = stunPortTCP
 	turnConfig.Realm = realm
+	turnConfig.PortTLS = cfg.Section("turn").Key("port_tls").MustInt(0)
+	turnConfig.PortDTLS = cfg.Section("turn").Key("port_dtls").MustInt(0)
+	turnConfig.RelayMinPort = cfg.Section("turn").Key("relay_min_port").MustInt(0)
+	turnConfig.RelayMaxPort = cfg.Section("turn").Key("relay_max_port").MustInt(0)
+	turnConfig.RelayAddress = cfg.Section("turn").Key("relay_address").String()
+	turnConfig.RelayAddressV6 = cfg.Section("turn").Key("relay_address_v6").String()
+	if cfg.Section("turn").HasKey("deny_peers") {
+		turnConfig.DeniedPeers = cfg.Section("turn").Key("deny_peers").Strings(",")
+	}
+	turnConfig.AllowedPeers = cfg.Section("turn").Key("allow_peers").Strings(",")
+	turnConfig.Quota.MaxAllocationsPerUser = cfg.Section("turn").Key("max_allocations_per_user").MustInt(0)
+	turnConfig.Quota.MaxAllocationsPerIP = cfg.Section("turn").Key("max_allocations_per_ip").MustInt(0)
+	turnConfig.Quota.MaxBandwidthPerUser = cfg.Section("turn").Key("max_bandwidth_per_user").MustInt(0)
+	turnConfig.Quota.MaxBandwidthPerIP = cfg.Section("turn").Key("max_bandwidth_per_ip").MustInt(0)
+	turnConfig.CertFile = turnCert
+	turnConfig.KeyFile = turnKey
 	turn := turn.NewTurnServer(turnConfig)
 
-	signaler := signaler.NewSignaler(turn)
-	wsServer := websocket.NewWebSocketServer(signaler.HandleNewWebSocket, signaler.HandleTurnServerCredentials)
+	signalerConfig := signaler.DefaultConfig()
+	signalerConfig.Auth.HMACSecret = cfg.Section("auth").Key("hs256_secret").String()
+	signalerConfig.Auth.JWKSFile = cfg.Section("auth").Key("jwks_file").String()
+	signalerConfig.Auth.Issuer = cfg.Section("auth").Key("issuer").String()
+	signalerConfig.Auth.Audience = cfg.Section("auth").Key("audience").String()
+
+	if ringTimeout, err := cfg.Section("signaling").Key("ring_timeout").Int(); err == nil {
+		if ringTimeout <= 0 {
+			logger.Errorf("Fail to read ring_timeout: must be at least 1 second, got %d", ringTimeout)
+			os.Exit(1)
+		}
+		signalerConfig.RingTimeout = time.Duration(ringTimeout) * time.Second
+	}
+
+	if busyMode := cfg.Section("signaling").Key("busy_mode").String(); len(busyMode) > 0 {
+		mode, err := signaler.ParseBusyMode(busyMode)
+		if err != nil {
+			logger.Errorf("Fail to read busy_mode: %v", err)
+			os.Exit(1)
+		}
+		signalerConfig.BusyMode = mode
+	}
+	busyModes, err := signaler.ParseBusyModes(cfg.Section("signaling").Key("busy_mode_by_role").String())
+	if err != nil {
+		logger.Errorf("Fail to read busy_mode_by_role: %v", err)
+		os.Exit(1)
+	}
+	signalerConfig.BusyModes = busyModes
+
+	if secrets := cfg.Section("turn").Key("shared_secret").Strings(","); len(secrets) > 0 {
+		signalerConfig.TurnSecrets = secrets
+	}
+	signalerConfig.TurnRequireIssued = cfg.Section("turn").Key("require_issued").MustBool(false)
+	if ttl, err := cfg.Section("turn").Key("credential_ttl").Int(); err == nil {
+		signalerConfig.TurnTTL = time.Duration(ttl) * time.Second
+	}
+	if maxTTL, err := cfg.Section("turn").Key("max_credential_ttl").Int(); err == nil {
+		signalerConfig.TurnMaxTTL = time.Duration(maxTTL) * time.Second
+	}
+	signalerConfig.TurnAPIKeys = cfg.Section("turn").Key("api_keys").Strings(",")
+	signalerConfig.TurnCORSOrigins = cfg.Section("turn").Key("cors_origins").Strings(",")
+	if rateLimit, err := cfg.Section("turn").Key("rate_limit_per_ip").Int(); err == nil {
+		signalerConfig.TurnRateLimitPerIP = rateLimit
+	}
+	if rateLimit, err := cfg.Section("turn").Key("rate_limit_per_user").Int(); err == nil {
+		signalerConfig.TurnRateLimitPerUser = rateLimit
+	}
+
+	signalerConfig.ICE.STUN = cfg.Section("ice").Key("stun").MustBool(true)
+	signalerConfig.ICE.STUNURLs = cfg.Section("ice").Key("stun_urls").Strings(",")
+	if serversFile := cfg.Section("ice").Key("servers_file").String(); len(serversFile) > 0 {
+		servers, err := signaler.LoadICEServers(serversFile)
+		if err != nil {
+			logger.Errorf("Fail to load ICE servers: %v", err)
+			os.Exit(1)
+		}
+		signalerConfig.ICE.Servers = servers
+	}
+
+	signalerConfig.AdminToken = cfg.Section("admin").Key("token").String()
+
+	if policyFile := cfg.Section("policy").Key("rules_file").String(); len(policyFile) > 0 {
+		policy, err := signaler.LoadRulePolicy(policyFile)
+		if err != nil {
+			logger.Errorf("Fail to load policy: %v", err)
+			os.Exit(1)
+		}
+		signalerConfig.Policy = policy
+	}
 
+	signaler := signaler.NewSignaler(turn, signalerConfig)
 	sslCert := cfg.Section("general").Key("cert").String()
 	sslKey := cfg.Section("general").Key("key").String()
 	bindAddress := cfg.Section("general").Key("bind").String()
@@ -55,7 +146,74 @@ func main() {
 	config.Port = port
 	config.CertFile = sslCert
 	config.KeyFile = sslKey
+	config.PlainHTTP = cfg.Section("general").Key("plain_http").MustBool(false)
+	config.Domain = cfg.Section("general").Key("domain").String()
+	config.ACME = cfg.Section("general").Key("acme").MustBool(false)
+	config.ACMEEmail = cfg.Section("general").Key("acme_email").String()
+	if cacheDir := cfg.Section("general").Key("acme_cache_dir").String(); len(cacheDir) > 0 {
+		config.ACMECacheDir = cacheDir
+	}
+	if httpPort, err := cfg.Section("general").Key("acme_http_port").Int(); err == nil {
+		config.ACMEHTTPPort = httpPort
+	}
 	config.HTMLRoot = htmlRoot
+	if cfg.Section("general").HasKey("metrics_path") {
+		config.MetricsPath = cfg.Section("general").Key("metrics_path").String()
+	}
+
+	if queueSize, err := cfg.Section("general").Key("send_queue_size").Int(); err == nil {
+		config.Conn.QueueSize = queueSize
+	}
+	if writeTimeout, err := cfg.Section("general").Key("write_timeout").Int(); err == nil {
+		config.Conn.WriteTimeout = time.Duration(writeTimeout) * time.Second
+	}
+	if overflow := cfg.Section("general").Key("send_queue_overflow").String(); len(overflow) > 0 {
+		policy, err := websocket.ParseOverflowPolicy(overflow)
+		if err != nil {
+			logger.Errorf("Fail to read send_queue_overflow: %v", err)
+			os.Exit(1)
+		}
+		config.Conn.Overflow = policy
+	}
+
+	config.Compression = cfg.Section("general").Key("compression").MustBool(true)
+	config.BinaryCodec = cfg.Section("general").Key("binary_codec").MustBool(true)
+	if threshold, err := cfg.Section("general").Key("compression_threshold").Int(); err == nil {
+		config.Conn.CompressionThreshold = threshold
+	}
+	if readLimit, err := cfg.Section("general").Key("max_message_size").Int64(); err == nil {
+		config.Conn.ReadLimit = readLimit
+	}
+	config.AllowedOrigins = cfg.Section("general").Key("allowed_origins").Strings(",")
+	config.MaxConnections = cfg.Section("general").Key("max_connections").MustInt(0)
+	config.MaxConnectionsPerIP = cfg.Section("general").Key("max_connections_per_ip").MustInt(0)
+	config.HandshakeRateLimit = cfg.Section("general").Key("handshake_rate_limit").MustInt(0)
+	config.TrustedProxies = cfg.Section("general").Key("trusted_proxies").Strings(",")
 
-	wsServer.Bind(config)
+	drainTimeout, err := cfg.Section("general").Key("drain_timeout").Int()
+	if err != nil {
+		drainTimeout = 30
+	}
+
+	wsServer := websocket.NewWebSocketServer(config, signaler.HandleNewWebSocket, signaler.HandleTurnServerCredentials, signaler.HandleAdmin)
+	if err := wsServer.Start(context.Background()); err != nil {
+		logger.Errorf("Fail to start HTTP server: %v", err)
+		os.Exit(1)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+	logger.Infof("Received %v, draining for up to %ds", sig, drainTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(drainTimeout)*time.Second)
+	defer cancel()
+	if err := wsServer.Shutdown(ctx); err != nil {
+		logger.Errorf("HTTP server shutdown: %v", err)
+	}
+	signaler.Shutdown(ctx)
+	if err := turn.Close(); err != nil {
+		logger.Errorf("TURN server shutdown: %v", err)
+	}
+	logger.Infof("Shutdown complete")
 }
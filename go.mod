@@ -4,9 +4,16 @@ go 1.12
 
 require (
 	github.com/chuckpreslar/emission v0.0.0-20170206194824-a7ddd980baf9
+	github.com/golang-jwt/jwt/v4 v4.5.2
 	github.com/gorilla/websocket v1.4.2
-	github.com/pion/turn/v2 v2.0.5
+	github.com/pion/dtls/v2 v2.2.7
+	github.com/pion/stun v0.6.1
+	github.com/pion/transport/v2 v2.2.1
+	github.com/pion/turn/v2 v2.1.6
+	github.com/prometheus/client_golang v1.12.2
 	github.com/rs/zerolog v1.23.0
 	github.com/smartystreets/goconvey v1.6.4 // indirect
+	golang.org/x/crypto v0.8.0
+	golang.org/x/time v0.3.0
 	gopkg.in/ini.v1 v1.62.0
 )
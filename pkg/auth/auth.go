@@ -0,0 +1,171 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	ErrMissingToken = errors.New("missing token")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+type AuthConfig struct {
+	// HMACSecret verifies HS256 tokens.
+	HMACSecret string
+	// JWKSFile is a JSON Web Key Set holding the RSA keys for RS256 tokens.
+	JWKSFile string
+	// Issuer and Audience are checked against `iss`/`aud` when set.
+	Issuer   string
+	Audience string
+}
+
+func DefaultConfig() AuthConfig {
+	return AuthConfig{}
+}
+
+// Claims are the JWT claims a peer presents. The `sub` claim is the peer ID,
+// `role` and `tags` feed the call authorization policy and `rooms`, when
+// present, lists the rooms the peer may be in ("*" for any).
+type Claims struct {
+	jwt.RegisteredClaims
+	Role  string   `json:"role,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	Rooms []string `json:"rooms,omitempty"`
+}
+
+type Verifier struct {
+	config  AuthConfig
+	hmacKey []byte
+	rsaKeys map[string]*rsa.PublicKey
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+func NewVerifier(config AuthConfig) (*Verifier, error) {
+	v := &Verifier{
+		config:  config,
+		rsaKeys: make(map[string]*rsa.PublicKey),
+	}
+	if len(config.HMACSecret) > 0 {
+		v.hmacKey = []byte(config.HMACSecret)
+	}
+	if len(config.JWKSFile) > 0 {
+		if err := v.loadJWKS(config.JWKSFile); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func (v *Verifier) loadJWKS(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read jwks %s: %v", path, err)
+	}
+	var set jsonWebKeySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("parse jwks %s: %v", path, err)
+	}
+	for _, key := range set.Keys {
+		if key.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return fmt.Errorf("jwks key %q: invalid modulus: %v", key.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return fmt.Errorf("jwks key %q: invalid exponent: %v", key.Kid, err)
+		}
+		v.rsaKeys[key.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(v.rsaKeys) == 0 {
+		return fmt.Errorf("jwks %s contains no RSA keys", path)
+	}
+	return nil
+}
+
+// Enabled reports whether any verification key is configured.
+func (v *Verifier) Enabled() bool {
+	return v != nil && (v.hmacKey != nil || len(v.rsaKeys) > 0)
+}
+
+func (v *Verifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		if v.hmacKey == nil {
+			return nil, ErrUnknownKey
+		}
+		return v.hmacKey, nil
+	case jwt.SigningMethodRS256.Alg():
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := v.rsaKeys[kid]; ok {
+			return key, nil
+		}
+		// Tokens without a kid are accepted when the set holds a single key.
+		if kid == "" && len(v.rsaKeys) == 1 {
+			for _, key := range v.rsaKeys {
+				return key, nil
+			}
+		}
+		return nil, ErrUnknownKey
+	}
+	return nil, ErrUnknownKey
+}
+
+// Verify checks the signature and registered claims of |tokenString|.
+func (v *Verifier) Verify(tokenString string) (*Claims, error) {
+	if tokenString == "" {
+		return nil, ErrMissingToken
+	}
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, v.keyFunc,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+	if len(v.config.Issuer) > 0 && !claims.VerifyIssuer(v.config.Issuer, true) {
+		return nil, errors.New("invalid issuer")
+	}
+	if len(v.config.Audience) > 0 && !claims.VerifyAudience(v.config.Audience, true) {
+		return nil, errors.New("invalid audience")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing subject")
+	}
+	return claims, nil
+}
+
+// TokenFromRequest extracts a bearer token from the `Authorization` header
+// or, for clients that cannot set headers on a WebSocket upgrade, the
+// `token` query parameter.
+func TokenFromRequest(request *http.Request) string {
+	header := request.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return request.URL.Query().Get("token")
+}
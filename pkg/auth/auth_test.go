@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const testSecret = "test-secret"
+
+func testClaims(subject string, expires time.Duration) Claims {
+	return Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			Issuer:    "https://issuer.example",
+			Audience:  jwt.ClaimStrings{"signaling"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expires)),
+		},
+		Role:  "caregiver",
+		Tags:  []string{"household-42"},
+		Rooms: []string{"lobby"},
+	}
+}
+
+func signHS256(t *testing.T, claims Claims, secret string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func signRS256(t *testing.T, claims Claims, key *rsa.PrivateKey, kid string) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// writeJWKS writes the public halves of |keys| as a key set and returns its
+// path.
+func writeJWKS(t *testing.T, keys map[string]*rsa.PrivateKey) string {
+	t.Helper()
+	var set jsonWebKeySet
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, jsonWebKey{
+			Kty: "RSA",
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifierVerify(t *testing.T) {
+	key1, key2, stranger := generateKey(t), generateKey(t), generateKey(t)
+	valid := testClaims("alice", time.Hour)
+	noSubject := testClaims("", time.Hour)
+
+	hmacOnly, err := NewVerifier(AuthConfig{HMACSecret: testSecret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict, err := NewVerifier(AuthConfig{HMACSecret: testSecret, Issuer: "https://issuer.example", Audience: "signaling"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherIssuer, err := NewVerifier(AuthConfig{HMACSecret: testSecret, Issuer: "https://other.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherAudience, err := NewVerifier(AuthConfig{HMACSecret: testSecret, Audience: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oneKey, err := NewVerifier(AuthConfig{JWKSFile: writeJWKS(t, map[string]*rsa.PrivateKey{"k1": key1})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	twoKeys, err := NewVerifier(AuthConfig{JWKSFile: writeJWKS(t, map[string]*rsa.PrivateKey{"k1": key1, "k2": key2})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, valid).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		verifier *Verifier
+		token    string
+		wantErr  bool
+	}{
+		{"HS256", hmacOnly, signHS256(t, valid, testSecret), false},
+		{"missing token", hmacOnly, "", true},
+		{"malformed token", hmacOnly, "not.a.token", true},
+		{"wrong secret", hmacOnly, signHS256(t, valid, "other-secret"), true},
+		{"expired", hmacOnly, signHS256(t, testClaims("alice", -time.Minute), testSecret), true},
+		{"missing subject", hmacOnly, signHS256(t, noSubject, testSecret), true},
+		{"alg none", hmacOnly, unsigned, true},
+		{"issuer and audience", strict, signHS256(t, valid, testSecret), false},
+		{"other issuer", otherIssuer, signHS256(t, valid, testSecret), true},
+		{"other audience", otherAudience, signHS256(t, valid, testSecret), true},
+		{"RS256 with kid", twoKeys, signRS256(t, valid, key2, "k2"), false},
+		{"RS256 with wrong kid", twoKeys, signRS256(t, valid, key2, "k1"), true},
+		{"RS256 unknown kid", twoKeys, signRS256(t, valid, key1, "k3"), true},
+		{"RS256 without kid, single key", oneKey, signRS256(t, valid, key1, ""), false},
+		{"RS256 without kid, several keys", twoKeys, signRS256(t, valid, key1, ""), true},
+		{"RS256 unknown key", oneKey, signRS256(t, valid, stranger, "k1"), true},
+		{"RS256 without JWKS", hmacOnly, signRS256(t, valid, key1, "k1"), true},
+		{"HS256 without secret", oneKey, signHS256(t, valid, testSecret), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims, err := test.verifier.Verify(test.token)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("Verify() accepted the token with claims %+v", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify() = %v", err)
+			}
+			if claims.Subject != valid.Subject || claims.Role != valid.Role ||
+				!reflect.DeepEqual(claims.Tags, valid.Tags) || !reflect.DeepEqual(claims.Rooms, valid.Rooms) {
+				t.Errorf("Verify() = %+v, want %+v", claims, valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "flutter_webrtc"
+
+var (
+	// PeersConnected is the number of registered signaling peers.
+	PeersConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "signaling",
+		Name:      "peers_connected",
+		Help:      "Number of registered signaling peers.",
+	})
+
+	// Messages counts inbound signaling messages by method.
+	Messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "signaling",
+		Name:      "messages_total",
+		Help:      "Inbound signaling messages by method.",
+	}, []string{"method"})
+
+	// ForwardFailures counts messages that could not be forwarded because
+	// the target peer was not found.
+	ForwardFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "signaling",
+		Name:      "forward_failures_total",
+		Help:      "Messages not forwarded because the target peer was not found.",
+	}, []string{"method"})
+
+	// ConnectionTimeouts counts connections dropped by the liveness checks.
+	ConnectionTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "timeouts_total",
+		Help:      "WebSocket connections closed by pong timeout, failed ping/keepalive or failed writes.",
+	}, []string{"reason"})
+
+	// WebSocketQueuedMessages is the number of messages waiting in the send
+	// queues of all connections.
+	WebSocketQueuedMessages = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "queued_messages",
+		Help:      "Messages waiting in WebSocket send queues.",
+	})
+
+	// WebSocketQueueOverflows counts full send queues by the action taken.
+	WebSocketQueueOverflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "queue_overflows_total",
+		Help:      "Full WebSocket send queues by action: drop_keepalive or disconnect.",
+	}, []string{"action"})
+
+	// TurnCredentialsIssued counts TURN credentials handed out.
+	TurnCredentialsIssued = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "turn",
+		Name:      "credentials_issued_total",
+		Help:      "TURN REST credentials issued.",
+	})
+
+	// TurnAuth counts TURN authentication attempts by result.
+	TurnAuth = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "turn",
+		Name:      "auth_total",
+		Help:      "TURN authentication attempts by result.",
+	}, []string{"result"})
+
+	// TurnPermissionsDenied counts permissions and channel binds refused
+	// because the peer address is in a denied network.
+	TurnPermissionsDenied = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "turn",
+		Name:      "permissions_denied_total",
+		Help:      "TURN permissions and channel binds refused for denied peer networks.",
+	})
+
+	// TurnQuotaExceeded counts allocations refused and relayed packets
+	// dropped by the per user and per IP quotas, by limit.
+	TurnQuotaExceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "turn",
+		Name:      "quota_exceeded_total",
+		Help:      "TURN allocations refused and relayed packets dropped by quota, by limit.",
+	}, []string{"limit"})
+
+	// TurnAllocations is the number of active TURN relay allocations.
+	TurnAllocations = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "turn",
+		Name:      "allocations_active",
+		Help:      "Active TURN relay allocations.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		PeersConnected,
+		Messages,
+		ForwardFailures,
+		ConnectionTimeouts,
+		WebSocketQueuedMessages,
+		WebSocketQueueOverflows,
+		TurnCredentialsIssued,
+		TurnAuth,
+		TurnPermissionsDenied,
+		TurnQuotaExceeded,
+		TurnAllocations,
+	)
+}
+
+// Handler serves the registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
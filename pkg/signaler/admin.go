@@ -0,0 +1,144 @@
+package signaler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/auth"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+)
+
+// PeerStatus is the admin view of a connected peer.
+type PeerStatus struct {
+	ID             string    `json:"id"`
+	Name           string    `json:"name"`
+	UserAgent      string    `json:"user_agent"`
+	Room           string    `json:"room,omitempty"`
+	RemoteAddr     string    `json:"remote_addr"`
+	ConnectedSince time.Time `json:"connected_since"`
+	// Relayed is set when the peer relays media through the TURN server.
+	Relayed bool          `json:"relayed"`
+	Relays  []RelayStatus `json:"relays,omitempty"`
+}
+
+// Peers returns a snapshot of the registered peers.
+func (s *Signaler) Peers() []PeerStatus {
+	s.peerMutex.RLock()
+	defer s.peerMutex.RUnlock()
+	peers := make([]PeerStatus, 0, len(s.peers))
+	for _, peer := range s.peers {
+		relays := s.Relays(peer.info.ID)
+		peers = append(peers, PeerStatus{
+			ID:             peer.info.ID,
+			Name:           peer.info.Name,
+			UserAgent:      peer.info.UserAgent,
+			Room:           peer.room,
+			RemoteAddr:     peer.remoteAddr,
+			ConnectedSince: peer.connectedAt,
+			Relayed:        s.relayed(peer.info.ID),
+			Relays:         relays,
+		})
+	}
+	return peers
+}
+
+// Kick closes the connection of peer |id|; the regular close handling then
+// removes it and hangs up its calls.
+func (s *Signaler) Kick(id string) bool {
+	s.peerMutex.RLock()
+	peer, ok := s.peers[id]
+	s.peerMutex.RUnlock()
+	if !ok {
+		return false
+	}
+	logger.Warnf("Admin: kicking peer %s", id)
+	peer.conn.Close()
+	return true
+}
+
+// SendTo delivers a server message to peer |id|.
+func (s *Signaler) SendTo(id string, m interface{}) bool {
+	s.peerMutex.RLock()
+	peer, ok := s.peers[id]
+	s.peerMutex.RUnlock()
+	if !ok {
+		return false
+	}
+	return s.Send(peer.conn, m) == nil
+}
+
+func (s *Signaler) authorizeAdmin(request *http.Request) bool {
+	if len(s.config.AdminToken) == 0 {
+		return false
+	}
+	token := auth.TokenFromRequest(request)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AdminToken)) == 1
+}
+
+func writeJSON(writer http.ResponseWriter, status int, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	json.NewEncoder(writer).Encode(v)
+}
+
+// HandleAdmin serves the admin API below its mount point:
+//
+//	GET    /peers              connected peers
+//	GET    /sessions           active sessions
+//	GET    /missed_calls       calls that rang out
+//	POST   /peers/{id}/kick    disconnect a peer
+//	POST   /peers/{id}/message send the request body to a peer
+//	POST   /turn/{user}/revoke revoke TURN credentials and allocations, and
+//	                           refuse new ones until revoked_until
+//	DELETE /turn/{user}/revoke lift a revocation
+func (s *Signaler) HandleAdmin(writer http.ResponseWriter, request *http.Request) {
+	if !s.authorizeAdmin(request) {
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "peers" && request.Method == http.MethodGet:
+		writeJSON(writer, http.StatusOK, s.Peers())
+	case len(parts) == 1 && parts[0] == "sessions" && request.Method == http.MethodGet:
+		writeJSON(writer, http.StatusOK, s.Sessions())
+	case len(parts) == 1 && parts[0] == "missed_calls" && request.Method == http.MethodGet:
+		writeJSON(writer, http.StatusOK, s.MissedCalls())
+	case len(parts) == 3 && parts[0] == "peers" && parts[2] == "kick" && request.Method == http.MethodPost:
+		if !s.Kick(parts[1]) {
+			http.Error(writer, "Peer not found", http.StatusNotFound)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[0] == "peers" && parts[2] == "message" && request.Method == http.MethodPost:
+		var message Request
+		if err := json.NewDecoder(request.Body).Decode(&message); err != nil || message.Type == "" {
+			http.Error(writer, "Invalid message", http.StatusBadRequest)
+			return
+		}
+		if !s.SendTo(parts[1], message) {
+			http.Error(writer, "Peer not found", http.StatusNotFound)
+			return
+		}
+		logger.Infof("Admin: sent %s to peer %s", message.Type, parts[1])
+		writer.WriteHeader(http.StatusNoContent)
+	case len(parts) == 3 && parts[0] == "turn" && parts[2] == "revoke" && request.Method == http.MethodPost:
+		closed, until := s.RevokeTurnCredentials(parts[1])
+		writeJSON(writer, http.StatusOK, map[string]interface{}{
+			"allocations_closed": closed,
+			"revoked_until":      until.UTC().Format(time.RFC3339),
+		})
+	case len(parts) == 3 && parts[0] == "turn" && parts[2] == "revoke" && request.Method == http.MethodDelete:
+		if !s.RestoreTurnCredentials(parts[1]) {
+			http.Error(writer, "Not revoked", http.StatusNotFound)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(writer, request)
+	}
+}
@@ -0,0 +1,98 @@
+package signaler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// BusyMode decides what happens to an offer for a peer that is already in
+// an active session.
+type BusyMode string
+
+const (
+	// BusyReject answers the caller with `busy`.
+	BusyReject BusyMode = "reject"
+	// BusyCallWaiting answers the caller with `busy` and sends the callee a
+	// `call_waiting` notification naming the caller.
+	BusyCallWaiting BusyMode = "call_waiting"
+	// BusyAllow forwards the offer and lets the callee juggle both calls.
+	BusyAllow BusyMode = "allow"
+)
+
+var errPeerBusy = errors.New("peer is busy")
+
+func ParseBusyMode(value string) (BusyMode, error) {
+	switch mode := BusyMode(strings.TrimSpace(value)); mode {
+	case BusyReject, BusyCallWaiting, BusyAllow:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid busy mode %q", value)
+}
+
+// ParseBusyModes parses a `role:mode,role:mode` list.
+func ParseBusyModes(value string) (map[string]BusyMode, error) {
+	modes := make(map[string]BusyMode)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid busy mode entry %q", entry)
+		}
+		mode, err := ParseBusyMode(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		modes[strings.TrimSpace(parts[0])] = mode
+	}
+	return modes, nil
+}
+
+// busyMode returns the mode configured for callees with |role|.
+func (s *Signaler) busyMode(role string) BusyMode {
+	if mode, ok := s.config.BusyModes[role]; ok {
+		return mode
+	}
+	if s.config.BusyMode == "" {
+		return BusyReject
+	}
+	return s.config.BusyMode
+}
+
+// busyLocked reports whether |peerID| is in an active session other than
+// |sessionID|. The caller must hold sessionMutex.
+func (s *Signaler) busyLocked(peerID string, sessionID string) bool {
+	for id, session := range s.sessions {
+		if id != sessionID && session.hasParty(peerID) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectBusy tells the caller of |negotiation| that the callee is busy and,
+// in call waiting mode, tells the callee who tried to reach it.
+func (s *Signaler) rejectBusy(caller Peer, callee Peer, negotiation Negotiation, mode BusyMode) {
+	s.Send(caller.conn, Request{
+		Type: Busy,
+		Data: map[string]interface{}{
+			"from":       callee.info.ID,
+			"to":         caller.info.ID,
+			"session_id": negotiation.SessionID,
+		},
+	})
+	if mode == BusyCallWaiting {
+		s.Send(callee.conn, Request{
+			Type: CallWaiting,
+			Data: map[string]interface{}{
+				"from":       caller.info.ID,
+				"to":         callee.info.ID,
+				"session_id": negotiation.SessionID,
+				"name":       caller.info.Name,
+			},
+		})
+	}
+}
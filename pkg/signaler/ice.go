@@ -0,0 +1,182 @@
+package signaler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+)
+
+// ICEServer is an entry of RTCConfiguration.iceServers.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEServers is the ready to use response of /api/turn?format=ice.
+type ICEServers struct {
+	ICEServers []ICEServer `json:"iceServers"`
+	TTL        int         `json:"ttl"`
+}
+
+// ExternalICEServer is an ICE server run outside this process, e.g. a
+// coturn fleet. Servers with a Secret share the TURN REST scheme and get
+// credentials minted for the same username; the others use the static
+// Username and Credential, if any.
+type ExternalICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+}
+
+// ICEConfig selects the ICE servers handed to clients besides the built-in
+// TURN server.
+type ICEConfig struct {
+	// STUN adds stun: URLs for the built-in server.
+	STUN bool
+	// STUNURLs are extra STUN servers, e.g. stun:stun.l.google.com:19302.
+	STUNURLs []string
+	Servers  []ExternalICEServer
+}
+
+// LoadICEServers reads a JSON array of ExternalICEServer from |path|.
+func LoadICEServers(path string) ([]ExternalICEServer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read ICE servers %s: %v", path, err)
+	}
+	var servers []ExternalICEServer
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return nil, fmt.Errorf("parse ICE servers %s: %v", path, err)
+	}
+	for i, server := range servers {
+		if len(server.URLs) == 0 {
+			return nil, fmt.Errorf("parse ICE servers %s: server %d has no urls", path, i)
+		}
+	}
+	return servers, nil
+}
+
+// stunURIs lists the stun: URIs of the built-in server, which answers
+// binding requests on its UDP port.
+func (s *Signaler) stunURIs() []string {
+	config := s.turn.Config
+	uris := []string{}
+	for _, host := range s.turnHosts() {
+		uris = append(uris, "stun:"+net.JoinHostPort(host, strconv.Itoa(config.Port)))
+	}
+	return uris
+}
+
+// iceServers builds the RTCIceServer list for |credential|.
+func (s *Signaler) iceServers(credential TurnCredentials) []ICEServer {
+	config := s.config.ICE
+	var stunURLs []string
+	if config.STUN {
+		stunURLs = append(stunURLs, s.stunURIs()...)
+	}
+	stunURLs = append(stunURLs, config.STUNURLs...)
+
+	servers := []ICEServer{}
+	if len(stunURLs) > 0 {
+		servers = append(servers, ICEServer{URLs: stunURLs})
+	}
+	servers = append(servers, ICEServer{
+		URLs:       credential.Uris,
+		Username:   credential.Username,
+		Credential: credential.Password,
+	})
+	for _, external := range config.Servers {
+		server := ICEServer{
+			URLs:       external.URLs,
+			Username:   external.Username,
+			Credential: external.Credential,
+		}
+		if len(external.Secret) > 0 {
+			server.Username = credential.Username
+			server.Credential = turnPassword(external.Secret, credential.Username)
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// iceRefreshAhead is the share of the credential TTL left when ice_servers
+// is pushed again, so long-lived connections never hold expired credentials.
+const iceRefreshAhead = 5
+
+// iceRetryDelay is how long a failed ice_servers push waits to be retried.
+const iceRetryDelay = 30 * time.Second
+
+// pushICEServers sends freshly minted ICE servers to |peer| once it has
+// registered, and keeps refreshing them before they expire. Credentials are
+// pushed under the same rules as /api/turn: only to authenticated peers
+// unless that API is open, never to revoked users and within the per-user
+// rate limit. Refreshes are not rate limited, there is one per connection.
+func (s *Signaler) pushICEServers(peer *Peer) {
+	if peer.claims == nil && !s.turnAPIOpen() {
+		return
+	}
+	if ok, retryAfter := s.turnUserLimiter.Allow(peer.info.ID); !ok {
+		logger.Warnf("Delaying ice_servers for peer %s by %v: rate limit exceeded", peer.info.ID, retryAfter)
+		s.scheduleICEServers(peer, retryAfter)
+		return
+	}
+	s.sendICEServers(peer)
+}
+
+// sendICEServers sends freshly minted ICE servers to |peer| and schedules
+// the next push before they expire, or a retry when sending failed.
+func (s *Signaler) sendICEServers(peer *Peer) {
+	if s.userRevoked(peer.info.ID) {
+		return
+	}
+	credential := s.issueTurnCredentials(peer.info.ID, s.config.TurnTTL)
+	err := s.Send(peer.conn, Request{
+		Type: ICEServersMethod,
+		Data: ICEServers{
+			ICEServers: s.iceServers(credential),
+			TTL:        credential.TTL,
+		},
+	})
+	if err != nil {
+		logger.Warnf("Failed to send ice_servers to peer %s: %v", peer.info.ID, err)
+		s.scheduleICEServers(peer, iceRetryDelay)
+		return
+	}
+	ttl := time.Duration(credential.TTL) * time.Second
+	s.scheduleICEServers(peer, ttl-ttl/iceRefreshAhead)
+}
+
+// scheduleICEServers sends ICE servers to |peer| after |delay|, as long as
+// it is still registered on the same connection.
+func (s *Signaler) scheduleICEServers(peer *Peer, delay time.Duration) {
+	s.peerMutex.Lock()
+	defer s.peerMutex.Unlock()
+	if s.peers[peer.info.ID] != peer {
+		// Disconnected or replaced meanwhile
+		return
+	}
+	stopICERefreshLocked(peer)
+	peer.iceRefresh = time.AfterFunc(delay, func() {
+		s.peerMutex.RLock()
+		current := s.peers[peer.info.ID] == peer
+		s.peerMutex.RUnlock()
+		if current {
+			s.sendICEServers(peer)
+		}
+	})
+}
+
+func stopICERefreshLocked(peer *Peer) {
+	if peer.iceRefresh != nil {
+		peer.iceRefresh.Stop()
+		peer.iceRefresh = nil
+	}
+}
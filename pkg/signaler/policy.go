@@ -0,0 +1,133 @@
+package signaler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// Subject is what a Policy knows about either end of a message.
+type Subject struct {
+	ID   string
+	Role string
+	Tags []string
+	Room string
+}
+
+func (p Peer) subject() Subject {
+	subject := Subject{
+		ID:   p.info.ID,
+		Room: p.room,
+	}
+	if p.claims != nil {
+		subject.Role = p.claims.Role
+		subject.Tags = p.claims.Tags
+	}
+	return subject
+}
+
+// Policy decides whether |from| may send a |method| message to |to|.
+// It is consulted before any offer, answer or candidate is forwarded.
+type Policy interface {
+	Allow(method Method, from Subject, to Subject) bool
+}
+
+// AllowAllPolicy forwards everything, which is the behaviour without a rule file.
+type AllowAllPolicy struct{}
+
+func (AllowAllPolicy) Allow(method Method, from Subject, to Subject) bool {
+	return true
+}
+
+// Selector matches a Subject. Every non-empty field has to match and an
+// empty selector matches anybody.
+type Selector struct {
+	ID   string `json:"id,omitempty"`
+	Role string `json:"role,omitempty"`
+	Tag  string `json:"tag,omitempty"`
+	Room string `json:"room,omitempty"`
+}
+
+func (sel Selector) match(subject Subject) bool {
+	if sel.ID != "" && sel.ID != subject.ID {
+		return false
+	}
+	if sel.Role != "" && sel.Role != subject.Role {
+		return false
+	}
+	if sel.Room != "" && sel.Room != subject.Room {
+		return false
+	}
+	if sel.Tag != "" {
+		for _, tag := range subject.Tags {
+			if tag == sel.Tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Rule lets peers matching From call peers matching To. With SameRoom set
+// both ends must also share a room.
+type Rule struct {
+	From     Selector `json:"from"`
+	To       Selector `json:"to"`
+	SameRoom bool     `json:"same_room,omitempty"`
+}
+
+func (r Rule) match(from Subject, to Subject) bool {
+	if r.SameRoom && from.Room != to.Room {
+		return false
+	}
+	return r.From.match(from) && r.To.match(to)
+}
+
+// RulePolicy is the built-in Policy loaded from a JSON rule file:
+//
+//	{
+//	  "rules": [
+//	    {"from": {"role": "caregiver"}, "to": {"tag": "household-42"}},
+//	    {"from": {"id": "alice"}, "to": {"id": "device-1"}},
+//	    {"same_room": true}
+//	  ]
+//	}
+//
+// Rules are directional for offers. Answers and candidates travel back along
+// a call, so they are allowed when a rule matches in either direction.
+// Anything no rule matches is denied.
+type RulePolicy struct {
+	Rules []Rule `json:"rules"`
+}
+
+func LoadRulePolicy(path string) (*RulePolicy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy %s: %v", path, err)
+	}
+	var policy RulePolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("parse policy %s: %v", path, err)
+	}
+	return &policy, nil
+}
+
+func (p *RulePolicy) allowed(from Subject, to Subject) bool {
+	for _, rule := range p.Rules {
+		if rule.match(from, to) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RulePolicy) Allow(method Method, from Subject, to Subject) bool {
+	if p.allowed(from, to) {
+		return true
+	}
+	if method != Offer {
+		return p.allowed(to, from)
+	}
+	return false
+}
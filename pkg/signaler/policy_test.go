@@ -0,0 +1,66 @@
+package signaler
+
+import "testing"
+
+func TestRulePolicyAllow(t *testing.T) {
+	policy := &RulePolicy{Rules: []Rule{
+		{From: Selector{Role: "caregiver"}, To: Selector{Tag: "household-42"}},
+		{From: Selector{ID: "alice"}, To: Selector{ID: "device-1"}},
+		{From: Selector{Room: "lobby"}, To: Selector{Room: "lobby"}, SameRoom: true},
+	}}
+	caregiver := Subject{ID: "carol", Role: "caregiver"}
+	household := Subject{ID: "device-42", Tags: []string{"kitchen", "household-42"}}
+	otherHousehold := Subject{ID: "device-43", Tags: []string{"household-43"}}
+	alice := Subject{ID: "alice"}
+	device := Subject{ID: "device-1"}
+	inLobby := Subject{ID: "dave", Room: "lobby"}
+	alsoInLobby := Subject{ID: "erin", Room: "lobby"}
+	elsewhere := Subject{ID: "frank", Room: "hall"}
+
+	tests := []struct {
+		name   string
+		method Method
+		from   Subject
+		to     Subject
+		want   bool
+	}{
+		{"role to tag", Offer, caregiver, household, true},
+		{"role to other tag", Offer, caregiver, otherHousehold, false},
+		{"offers are directional", Offer, household, caregiver, false},
+		{"answers travel back", Answer, household, caregiver, true},
+		{"candidates travel back", Candidate, household, caregiver, true},
+		{"answer without a rule", Answer, otherHousehold, caregiver, false},
+		{"id to id", Offer, alice, device, true},
+		{"id to other id", Offer, alice, household, false},
+		{"same room", Offer, inLobby, alsoInLobby, true},
+		{"other room", Offer, inLobby, elsewhere, false},
+		{"no rule", Offer, Subject{ID: "mallory"}, device, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := policy.Allow(test.method, test.from, test.to); got != test.want {
+				t.Errorf("Allow(%s, %s, %s) = %v, want %v", test.method, test.from.ID, test.to.ID, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRulePolicyEmptySelector(t *testing.T) {
+	policy := &RulePolicy{Rules: []Rule{{SameRoom: true}}}
+	tests := []struct {
+		name string
+		from Subject
+		to   Subject
+		want bool
+	}{
+		{"same room", Subject{ID: "a", Room: "r1"}, Subject{ID: "b", Room: "r1"}, true},
+		{"other room", Subject{ID: "a", Room: "r1"}, Subject{ID: "b", Room: "r2"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := policy.Allow(Offer, test.from, test.to); got != test.want {
+				t.Errorf("Allow() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package signaler
+
+import (
+	"time"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/turn"
+)
+
+// RelayStatus is the admin view of a TURN allocation. Allocations belong to
+// the peer whose ID is the userid of the TURN REST username.
+type RelayStatus struct {
+	Username    string     `json:"username"`
+	ClientAddr  string     `json:"client_addr"`
+	RelayAddr   string     `json:"relay_addr"`
+	Permissions []string   `json:"permissions,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RefreshedAt *time.Time `json:"refreshed_at,omitempty"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+}
+
+// handleAllocationEvent keeps the allocations of every user up to date.
+func (s *Signaler) handleAllocationEvent(event turn.AllocationEvent) {
+	user := turn.UsernameUser(event.Username)
+	relayAddr := event.RelayAddr.String()
+	now := time.Now()
+
+	s.relayMutex.Lock()
+	defer s.relayMutex.Unlock()
+	relays := s.relays[user]
+	switch event.Type {
+	case turn.AllocationCreated:
+		if relays == nil {
+			relays = make(map[string]*RelayStatus)
+			s.relays[user] = relays
+		}
+		relays[relayAddr] = &RelayStatus{
+			Username:   event.Username,
+			ClientAddr: event.ClientAddr.String(),
+			RelayAddr:  relayAddr,
+			CreatedAt:  now,
+			ExpiresAt:  now.Add(event.Lifetime),
+		}
+		logger.Infof("TURN allocation created: user=%s client=%s relay=%s", user, event.ClientAddr, relayAddr)
+	case turn.AllocationRefreshed:
+		if relay, ok := relays[relayAddr]; ok {
+			relay.RefreshedAt = &now
+			relay.ExpiresAt = now.Add(event.Lifetime)
+		}
+	case turn.PermissionCreated:
+		if relay, ok := relays[relayAddr]; ok {
+			relay.Permissions = append(relay.Permissions, event.PeerAddr.String())
+		}
+	case turn.AllocationDeleted:
+		delete(relays, relayAddr)
+		if len(relays) == 0 {
+			delete(s.relays, user)
+		}
+		logger.Infof("TURN allocation deleted: user=%s client=%s relay=%s", user, event.ClientAddr, relayAddr)
+	}
+}
+
+// Relays returns a snapshot of the allocations of peer |id|.
+func (s *Signaler) Relays(id string) []RelayStatus {
+	s.relayMutex.RLock()
+	defer s.relayMutex.RUnlock()
+	relays := make([]RelayStatus, 0, len(s.relays[id]))
+	for _, relay := range s.relays[id] {
+		status := *relay
+		status.Permissions = append([]string{}, relay.Permissions...)
+		relays = append(relays, status)
+	}
+	return relays
+}
+
+// relayed reports whether peer |id| has an allocation with permissions,
+// i.e. is sending media through the TURN server rather than directly.
+func (s *Signaler) relayed(id string) bool {
+	s.relayMutex.RLock()
+	defer s.relayMutex.RUnlock()
+	for _, relay := range s.relays[id] {
+		if len(relay.Permissions) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package signaler
+
+import (
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/websocket"
+)
+
+// DefaultRoom is the room a peer lands in when its `new` message does not
+// name one, so clients that predate rooms keep seeing each other.
+const DefaultRoom = "default"
+
+type RoomRequest struct {
+	Room string `json:"room"`
+}
+
+// mayEnter reports whether |peer| may be in |room|. Peers whose token has a
+// `rooms` claim are kept to those rooms; everyone else may enter any room.
+func (peer Peer) mayEnter(room string) bool {
+	if peer.claims == nil || peer.claims.Rooms == nil {
+		return true
+	}
+	for _, allowed := range peer.claims.Rooms {
+		if allowed == "*" || allowed == room {
+			return true
+		}
+	}
+	return false
+}
+
+// moveToRoomLocked removes |peer| from its current room and adds it to |room|.
+// An empty |room| leaves the peer registered but outside of any room.
+// It returns the previous room. The caller must hold peerMutex for writing.
+func (s *Signaler) moveToRoomLocked(peer *Peer, room string) string {
+	prev := peer.room
+	if prev == room {
+		return prev
+	}
+	if members, ok := s.rooms[prev]; ok {
+		if members[peer.info.ID] == peer {
+			delete(members, peer.info.ID)
+		}
+		if len(members) == 0 {
+			delete(s.rooms, prev)
+		}
+	}
+	peer.room = room
+	peer.info.Room = room
+	if room != "" {
+		members, ok := s.rooms[room]
+		if !ok {
+			members = make(map[string]*Peer)
+			s.rooms[room] = members
+		}
+		members[peer.info.ID] = peer
+	}
+	return prev
+}
+
+// peerForConn returns a copy of the peer registered on |conn|.
+func (s *Signaler) peerForConn(conn *websocket.WebSocketConn) (Peer, bool) {
+	s.peerMutex.RLock()
+	defer s.peerMutex.RUnlock()
+	if peer := s.peerForConnLocked(conn); peer != nil {
+		return *peer, true
+	}
+	return Peer{}, false
+}
+
+// peerForConnLocked returns the peer registered on |conn|, or nil. The
+// caller must hold peerMutex.
+func (s *Signaler) peerForConnLocked(conn *websocket.WebSocketConn) *Peer {
+	for _, peer := range s.peers {
+		if peer.conn == conn {
+			return peer
+		}
+	}
+	return nil
+}
+
+// peerInRoom returns a copy of peer |id| if it is a member of |room|.
+func (s *Signaler) peerInRoom(room string, id string) (Peer, bool) {
+	s.peerMutex.RLock()
+	defer s.peerMutex.RUnlock()
+	if room == "" {
+		return Peer{}, false
+	}
+	peer, ok := s.rooms[room][id]
+	if !ok {
+		return Peer{}, false
+	}
+	return *peer, true
+}
+
+// notifyLeave tells the members of |room| that peer |id| has left it.
+func (s *Signaler) notifyLeave(room string, id string) {
+	if room == "" {
+		return
+	}
+	s.peerMutex.RLock()
+	conns := make([]*websocket.WebSocketConn, 0, len(s.rooms[room]))
+	for _, peer := range s.rooms[room] {
+		if peer.info.ID != id {
+			conns = append(conns, peer.conn)
+		}
+	}
+	s.peerMutex.RUnlock()
+
+	leave := Request{
+		Type: "leave",
+		Data: map[string]interface{}{
+			"id": id,
+		},
+	}
+	for _, c := range conns {
+		s.Send(c, leave)
+	}
+}
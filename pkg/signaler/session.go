@@ -0,0 +1,287 @@
+package signaler
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+)
+
+type SessionState string
+
+const (
+	SessionRinging   SessionState = "ringing"
+	SessionAnswered  SessionState = "answered"
+	SessionConnected SessionState = "connected"
+	SessionEnded     SessionState = "ended"
+)
+
+// Reasons a session ended with, echoed in the `bye` sent by the server.
+const (
+	EndHangup       = "hangup"
+	EndDisconnected = "disconnected"
+	EndTimeout      = "timeout"
+)
+
+// maxMissedCalls bounds the history of calls that rang out.
+const maxMissedCalls = 100
+
+var (
+	errSessionUnknown  = errors.New("unknown session")
+	errSessionState    = errors.New("message out of order for session")
+	errSessionNotParty = errors.New("peer is not part of session")
+)
+
+// Session is the server side view of a call between two peers, keyed by the
+// client chosen `session_id`.
+type Session struct {
+	ID          string       `json:"id"`
+	Caller      string       `json:"caller"`
+	Callee      string       `json:"callee"`
+	State       SessionState `json:"state"`
+	CreatedAt   time.Time    `json:"created_at"`
+	AnsweredAt  *time.Time   `json:"answered_at,omitempty"`
+	ConnectedAt *time.Time   `json:"connected_at,omitempty"`
+	EndedAt     *time.Time   `json:"ended_at,omitempty"`
+	EndedBy     string       `json:"ended_by,omitempty"`
+	EndReason   string       `json:"end_reason,omitempty"`
+	// Relayed is set in snapshots when either party relays media through
+	// the TURN server.
+	Relayed bool `json:"relayed"`
+
+	callerCandidates bool
+	calleeCandidates bool
+	ringTimer        *time.Timer
+}
+
+func (session *Session) hasParty(id string) bool {
+	return session.Caller == id || session.Callee == id
+}
+
+// other returns the party of |session| that is not |id|.
+func (session *Session) other(id string) string {
+	if session.Caller == id {
+		return session.Callee
+	}
+	return session.Caller
+}
+
+// namesParties reports whether session |id| may be opened between |a| and
+// |b|. IDs following the "a~b" convention, which bye falls back on, must
+// name both, so no other peer can take them first.
+func namesParties(id string, a string, b string) bool {
+	ids := strings.Split(id, "~")
+	if len(ids) != 2 {
+		return true
+	}
+	return (ids[0] == a && ids[1] == b) || (ids[0] == b && ids[1] == a)
+}
+
+// advanceSession applies a negotiation message sent by |from| to the session
+// it names and rejects messages that do not fit the current state. New offers
+// to a callee that is already in a call fail with errPeerBusy unless |busy|
+// is BusyAllow.
+func (s *Signaler) advanceSession(method Method, negotiation Negotiation, from string, busy BusyMode) error {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	session, ok := s.sessions[negotiation.SessionID]
+	if ok && (!session.hasParty(from) || !session.hasParty(negotiation.To)) {
+		return errSessionNotParty
+	}
+	now := time.Now()
+	switch method {
+	case Offer:
+		if !ok {
+			id := negotiation.SessionID
+			if !namesParties(id, from, negotiation.To) {
+				return errSessionNotParty
+			}
+			if busy != BusyAllow && s.busyLocked(negotiation.To, id) {
+				return errPeerBusy
+			}
+			s.sessions[id] = &Session{
+				ID:        id,
+				Caller:    from,
+				Callee:    negotiation.To,
+				State:     SessionRinging,
+				CreatedAt: now,
+				ringTimer: time.AfterFunc(s.ringTimeout(negotiation), func() {
+					s.ringOut(id)
+				}),
+			}
+			return nil
+		}
+		// A repeated offer from the caller while ringing, or from either side
+		// once answered, is an ICE restart or renegotiation.
+		if session.State == SessionRinging && from != session.Caller {
+			return errSessionState
+		}
+	case Answer:
+		if !ok {
+			return errSessionUnknown
+		}
+		if session.State == SessionRinging {
+			if from != session.Callee {
+				return errSessionState
+			}
+			session.State = SessionAnswered
+			session.AnsweredAt = &now
+			session.ringTimer.Stop()
+		}
+	case Candidate:
+		if !ok {
+			return errSessionUnknown
+		}
+		if from == session.Caller {
+			session.callerCandidates = true
+		} else {
+			session.calleeCandidates = true
+		}
+		// Both sides trickling candidates on an answered call means
+		// signaling is done and ICE is connecting.
+		if session.State == SessionAnswered && session.callerCandidates && session.calleeCandidates {
+			session.State = SessionConnected
+			session.ConnectedAt = &now
+		}
+	}
+	return nil
+}
+
+// endSession removes session |id| and records why and by whom it ended. A
+// non-empty |by| must be a party of the session; an empty one means the
+// server ended it.
+func (s *Signaler) endSession(id string, by string, reason string) (Session, error) {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	return s.endSessionLocked(id, "", by, reason)
+}
+
+// endSessionIf ends session |id| like endSession, but only while it is in
+// |state|; otherwise it fails with errSessionState.
+func (s *Signaler) endSessionIf(id string, state SessionState, by string, reason string) (Session, error) {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	return s.endSessionLocked(id, state, by, reason)
+}
+
+// endSessionLocked ends session |id| if it is in |state|, or in any state
+// when |state| is empty. The caller must hold sessionMutex.
+func (s *Signaler) endSessionLocked(id string, state SessionState, by string, reason string) (Session, error) {
+	session, ok := s.sessions[id]
+	if !ok {
+		return Session{}, errSessionUnknown
+	}
+	if by != "" && !session.hasParty(by) {
+		return Session{}, errSessionNotParty
+	}
+	if state != "" && session.State != state {
+		return Session{}, errSessionState
+	}
+	delete(s.sessions, id)
+	session.ringTimer.Stop()
+	now := time.Now()
+	session.State = SessionEnded
+	session.EndedAt = &now
+	session.EndedBy = by
+	session.EndReason = reason
+	return *session, nil
+}
+
+// ringTimeout is the configured ring timeout, or the shorter one the caller
+// asked for in its offer.
+func (s *Signaler) ringTimeout(negotiation Negotiation) time.Duration {
+	timeout := s.config.RingTimeout
+	requested := time.Duration(negotiation.RingTimeout) * time.Second
+	if requested > 0 && requested < timeout {
+		return requested
+	}
+	return timeout
+}
+
+// ringOut ends session |id| if it is still ringing, tells both parties and
+// records the missed call.
+func (s *Signaler) ringOut(id string) {
+	ended, err := s.endSessionIf(id, SessionRinging, "", EndTimeout)
+	if err != nil {
+		// Answered or ended meanwhile
+		return
+	}
+	s.sessionMutex.Lock()
+	s.missedCalls = append(s.missedCalls, ended)
+	if len(s.missedCalls) > maxMissedCalls {
+		s.missedCalls = s.missedCalls[len(s.missedCalls)-maxMissedCalls:]
+	}
+	s.sessionMutex.Unlock()
+
+	logger.Infof("Session %s: %s did not answer %s, missed call", ended.ID, ended.Callee, ended.Caller)
+	s.sendBye(ended, ended.Callee, ended.Caller)
+	s.sendBye(ended, ended.Caller, ended.Callee)
+}
+
+// MissedCalls returns the most recent calls that rang out unanswered.
+func (s *Signaler) MissedCalls() []Session {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	calls := make([]Session, len(s.missedCalls))
+	copy(calls, s.missedCalls)
+	return calls
+}
+
+// sessionsOf returns the IDs of the active sessions |peerID| takes part in.
+func (s *Signaler) sessionsOf(peerID string) []string {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	ids := []string{}
+	for id, session := range s.sessions {
+		if session.hasParty(peerID) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Sessions returns a snapshot of the active sessions.
+func (s *Signaler) Sessions() []Session {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	sessions := make([]Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		snapshot := *session
+		snapshot.Relayed = s.relayed(session.Caller) || s.relayed(session.Callee)
+		sessions = append(sessions, snapshot)
+	}
+	return sessions
+}
+
+// sendBye tells |to| that |session| is over.
+func (s *Signaler) sendBye(session Session, from string, to string) {
+	s.peerMutex.RLock()
+	peer, ok := s.peers[to]
+	s.peerMutex.RUnlock()
+	if !ok {
+		return
+	}
+	s.Send(peer.conn, Request{
+		Type: "bye",
+		Data: map[string]interface{}{
+			"from":       from,
+			"to":         to,
+			"session_id": session.ID,
+			"reason":     session.EndReason,
+		},
+	})
+}
+
+// hangupPeer ends every session of |peerID| with |reason| and says bye to
+// the parties left behind.
+func (s *Signaler) hangupPeer(peerID string, reason string) {
+	for _, id := range s.sessionsOf(peerID) {
+		session, err := s.endSession(id, peerID, reason)
+		if err != nil {
+			continue
+		}
+		logger.Infof("Session %s ended: %s left (%s)", session.ID, peerID, reason)
+		s.sendBye(session, peerID, session.other(peerID))
+	}
+}
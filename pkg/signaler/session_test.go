@@ -0,0 +1,285 @@
+package signaler
+
+import (
+	"testing"
+)
+
+// newSessionSignaler returns a Signaler with just enough state for the
+// session registry.
+func newSessionSignaler() *Signaler {
+	return &Signaler{
+		peers:    make(map[string]*Peer),
+		rooms:    make(map[string]map[string]*Peer),
+		sessions: make(map[string]*Session),
+		relays:   make(map[string]map[string]*RelayStatus),
+		config:   DefaultConfig(),
+		policy:   AllowAllPolicy{},
+	}
+}
+
+// step is one negotiation message sent by From to To.
+type step struct {
+	method  Method
+	from    string
+	to      string
+	session string
+	busy    BusyMode
+	err     error
+}
+
+func offer(from, to, session string) step {
+	return step{method: Offer, from: from, to: to, session: session}
+}
+
+func answer(from, to, session string) step {
+	return step{method: Answer, from: from, to: to, session: session}
+}
+
+func candidate(from, to, session string) step {
+	return step{method: Candidate, from: from, to: to, session: session}
+}
+
+func (st step) fails(err error) step {
+	st.err = err
+	return st
+}
+
+func (st step) with(busy BusyMode) step {
+	st.busy = busy
+	return st
+}
+
+func stopRingTimers(s *Signaler) {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	for _, session := range s.sessions {
+		session.ringTimer.Stop()
+	}
+}
+
+func TestAdvanceSession(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []step
+		// state of session "a~b" afterwards, empty when it must not exist
+		state SessionState
+	}{
+		{"offer rings", []step{offer("a", "b", "a~b")}, SessionRinging},
+		{"callee answers", []step{offer("a", "b", "a~b"), answer("b", "a", "a~b")}, SessionAnswered},
+		{"caller cannot answer", []step{
+			offer("a", "b", "a~b"),
+			answer("a", "b", "a~b").fails(errSessionState),
+		}, SessionRinging},
+		{"answer without offer", []step{answer("b", "a", "a~b").fails(errSessionUnknown)}, ""},
+		{"candidate without offer", []step{candidate("a", "b", "a~b").fails(errSessionUnknown)}, ""},
+		{"candidates while ringing", []step{
+			offer("a", "b", "a~b"),
+			candidate("a", "b", "a~b"),
+			candidate("b", "a", "a~b"),
+		}, SessionRinging},
+		{"one side trickling", []step{
+			offer("a", "b", "a~b"),
+			answer("b", "a", "a~b"),
+			candidate("a", "b", "a~b"),
+		}, SessionAnswered},
+		{"both sides trickling", []step{
+			offer("a", "b", "a~b"),
+			answer("b", "a", "a~b"),
+			candidate("a", "b", "a~b"),
+			candidate("b", "a", "a~b"),
+		}, SessionConnected},
+		{"candidates before the answer count", []step{
+			offer("a", "b", "a~b"),
+			candidate("a", "b", "a~b"),
+			answer("b", "a", "a~b"),
+			candidate("b", "a", "a~b"),
+		}, SessionConnected},
+		{"caller repeats offer while ringing", []step{
+			offer("a", "b", "a~b"),
+			offer("a", "b", "a~b"),
+		}, SessionRinging},
+		{"callee cannot offer while ringing", []step{
+			offer("a", "b", "a~b"),
+			offer("b", "a", "a~b").fails(errSessionState),
+		}, SessionRinging},
+		{"renegotiation by callee", []step{
+			offer("a", "b", "a~b"),
+			answer("b", "a", "a~b"),
+			offer("b", "a", "a~b"),
+			answer("a", "b", "a~b"),
+		}, SessionAnswered},
+		{"stranger cannot answer", []step{
+			offer("a", "b", "a~b"),
+			answer("c", "a", "a~b").fails(errSessionNotParty),
+		}, SessionRinging},
+		{"stranger cannot be reached", []step{
+			offer("a", "b", "a~b"),
+			candidate("a", "c", "a~b").fails(errSessionNotParty),
+		}, SessionRinging},
+		{"stranger cannot take a legacy id", []step{
+			offer("c", "b", "a~b").fails(errSessionNotParty),
+			offer("a", "b", "a~b"),
+		}, SessionRinging},
+		{"legacy id naming the caller last", []step{offer("b", "a", "a~b")}, SessionRinging},
+		{"busy callee", []step{
+			offer("c", "b", "c~b"),
+			offer("a", "b", "a~b").fails(errPeerBusy),
+		}, ""},
+		{"busy callee with call waiting", []step{
+			offer("c", "b", "c~b"),
+			offer("a", "b", "a~b").with(BusyCallWaiting).fails(errPeerBusy),
+		}, ""},
+		{"busy callee allowing a second call", []step{
+			offer("c", "b", "c~b"),
+			offer("a", "b", "a~b").with(BusyAllow),
+		}, SessionRinging},
+		{"busy caller can still call", []step{
+			offer("a", "c", "a~c"),
+			offer("a", "b", "a~b"),
+		}, SessionRinging},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSessionSignaler()
+			defer stopRingTimers(s)
+			for i, st := range test.steps {
+				busy := st.busy
+				if busy == "" {
+					busy = BusyReject
+				}
+				negotiation := Negotiation{From: st.from, To: st.to, SessionID: st.session}
+				if err := s.advanceSession(st.method, negotiation, st.from, busy); err != st.err {
+					t.Fatalf("step %d (%s from %s): got %v, want %v", i, st.method, st.from, err, st.err)
+				}
+			}
+			session, ok := s.sessions["a~b"]
+			switch {
+			case test.state == "" && ok:
+				t.Errorf("session a~b exists in state %s", session.State)
+			case test.state != "" && !ok:
+				t.Errorf("session a~b does not exist, want %s", test.state)
+			case ok && session.State != test.state:
+				t.Errorf("session a~b is %s, want %s", session.State, test.state)
+			}
+		})
+	}
+}
+
+func TestEndSession(t *testing.T) {
+	tests := []struct {
+		name    string
+		session string
+		state   SessionState
+		by      string
+		err     error
+	}{
+		{"by the caller", "a~b", "", "a", nil},
+		{"by the callee", "a~b", "", "b", nil},
+		{"by the server", "a~b", "", "", nil},
+		{"by a stranger", "a~b", "", "c", errSessionNotParty},
+		{"unknown session", "a~c", "", "a", errSessionUnknown},
+		{"while ringing", "a~b", SessionRinging, "", nil},
+		{"no longer ringing", "a~b", SessionAnswered, "", errSessionState},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSessionSignaler()
+			defer stopRingTimers(s)
+			if err := s.advanceSession(Offer, Negotiation{To: "b", SessionID: "a~b"}, "a", BusyReject); err != nil {
+				t.Fatal(err)
+			}
+			ended, err := s.endSessionIf(test.session, test.state, test.by, EndHangup)
+			if err != test.err {
+				t.Fatalf("got %v, want %v", err, test.err)
+			}
+			_, exists := s.sessions["a~b"]
+			if err != nil {
+				if !exists {
+					t.Error("session a~b was removed after a refused end")
+				}
+				return
+			}
+			if exists {
+				t.Error("session a~b still exists")
+			}
+			if ended.State != SessionEnded || ended.EndedBy != test.by || ended.EndReason != EndHangup || ended.EndedAt == nil {
+				t.Errorf("ended session is %+v", ended)
+			}
+		})
+	}
+}
+
+func TestRingOut(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  []step
+		missed bool
+	}{
+		{"unanswered", []step{offer("a", "b", "a~b")}, true},
+		{"answered", []step{offer("a", "b", "a~b"), answer("b", "a", "a~b")}, false},
+		{"connected", []step{
+			offer("a", "b", "a~b"),
+			answer("b", "a", "a~b"),
+			candidate("a", "b", "a~b"),
+			candidate("b", "a", "a~b"),
+		}, false},
+		{"already ended", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newSessionSignaler()
+			defer stopRingTimers(s)
+			for _, st := range test.steps {
+				negotiation := Negotiation{To: st.to, SessionID: st.session}
+				if err := s.advanceSession(st.method, negotiation, st.from, BusyReject); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.ringOut("a~b")
+
+			_, exists := s.sessions["a~b"]
+			if exists == test.missed && len(test.steps) > 0 {
+				t.Errorf("session a~b exists: %v, want %v", exists, !test.missed)
+			}
+			missed := s.MissedCalls()
+			if test.missed != (len(missed) == 1) {
+				t.Fatalf("missed calls %+v, want missed: %v", missed, test.missed)
+			}
+			if test.missed && (missed[0].EndReason != EndTimeout || missed[0].Callee != "b") {
+				t.Errorf("missed call is %+v", missed[0])
+			}
+		})
+	}
+}
+
+func TestBusyLocked(t *testing.T) {
+	s := newSessionSignaler()
+	defer stopRingTimers(s)
+	for _, st := range []step{offer("a", "b", "a~b"), offer("c", "d", "c~d")} {
+		if err := s.advanceSession(st.method, Negotiation{To: st.to, SessionID: st.session}, st.from, BusyReject); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		peer    string
+		session string
+		want    bool
+	}{
+		{"a", "", true},
+		{"b", "", true},
+		{"b", "e~b", true},
+		{"b", "a~b", false},
+		{"d", "a~b", true},
+		{"e", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.peer+" "+test.session, func(t *testing.T) {
+			s.sessionMutex.Lock()
+			got := s.busyLocked(test.peer, test.session)
+			s.sessionMutex.Unlock()
+			if got != test.want {
+				t.Errorf("busyLocked(%s, %q) = %v, want %v", test.peer, test.session, got, test.want)
+			}
+		})
+	}
+}
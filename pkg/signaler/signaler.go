@@ -1,7 +1,9 @@
 package signaler
 
 import (
+	"context"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
@@ -9,20 +11,19 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/auth"
 	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/metrics"
 	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/turn"
 	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/util"
 	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/websocket"
 )
 
-const (
-	sharedKey = `flutter-webrtc-turn-server-shared-key`
-)
-
 type TurnCredentials struct {
 	Username string   `json:"username"`
 	Password string   `json:"password"`
@@ -32,8 +33,15 @@ type TurnCredentials struct {
 
 // Peer .
 type Peer struct {
-	info PeerInfo
-	conn *websocket.WebSocketConn
+	info   PeerInfo
+	conn   *websocket.WebSocketConn
+	room   string
+	claims *auth.Claims
+
+	remoteAddr  string
+	connectedAt time.Time
+	// iceRefresh re-sends ice_servers before the credentials expire.
+	iceRefresh *time.Timer
 }
 
 type Method string
@@ -46,6 +54,13 @@ const (
 	Candidate Method = "candidate"
 	Leave     Method = "leave"
 	Keepalive Method = "keepalive"
+	Join      Method = "join"
+	LeaveRoom Method = "leave_room"
+	// Sent by the server only.
+	Busy             Method = "busy"
+	CallWaiting      Method = "call_waiting"
+	ServerShutdown   Method = "server_shutdown"
+	ICEServersMethod Method = "ice_servers"
 )
 
 type Request struct {
@@ -57,63 +72,236 @@ type PeerInfo struct {
 	ID        string `json:"id"`
 	Name      string `json:"name"`
 	UserAgent string `json:"user_agent"`
+	Room      string `json:"room,omitempty"`
+}
+
+// Registration carries the credentials of a `new` message. It is decoded
+// separately from PeerInfo so the token is never echoed in `peers` lists.
+type Registration struct {
+	Token string `json:"token"`
 }
 
 type Negotiation struct {
 	From      string `json:"from"`
 	To        string `json:"to"`
 	SessionID string `json:"session_id"`
+	// RingTimeout optionally shortens how long an offer rings, in seconds.
+	RingTimeout int `json:"ring_timeout,omitempty"`
 }
 
 type Byebye struct {
 	SessionID string `json:"session_id"`
 	From      string `json:"from"`
+	Reason    string `json:"reason,omitempty"`
 }
 
+// Error codes let clients tell rejections apart without parsing Reason.
+const (
+	ErrorUnauthorized = "unauthorized"
+	ErrorForbidden    = "forbidden"
+	ErrorInvalidState = "invalid_state"
+)
+
 type Error struct {
 	Request string `json:"request"`
 	Reason  string `json:"reason"`
+	Code    string `json:"code,omitempty"`
+}
+
+type SignalerConfig struct {
+	Auth auth.AuthConfig
+	// Policy authorizes forwarded messages; nil allows everything.
+	Policy Policy
+	// RingTimeout is how long an offer may stay unanswered, the default
+	// when not positive.
+	RingTimeout time.Duration
+	// BusyMode handles offers to peers already in a call, BusyModes
+	// overrides it for callees with a given role.
+	BusyMode  BusyMode
+	BusyModes map[string]BusyMode
+	// AdminToken is the bearer token for the admin API; empty disables it.
+	AdminToken string
+	// TurnSecrets are the TURN REST shared secrets. The first one signs new
+	// credentials, all of them are accepted so secrets can be rotated. When
+	// empty a random secret is generated at startup.
+	TurnSecrets []string
+	// TurnRequireIssued only accepts credentials issued by this instance.
+	TurnRequireIssued bool
+	// TurnTTL is the lifetime of issued TURN credentials. Clients may ask
+	// for up to TurnMaxTTL with the ttl query parameter.
+	TurnTTL    time.Duration
+	TurnMaxTTL time.Duration
+	// ICE adds STUN and external servers to the iceServers responses.
+	ICE ICEConfig
+	// TurnAPIKeys are accepted by /api/turn besides JWTs. Without either
+	// the endpoint is open.
+	TurnAPIKeys []string
+	// TurnCORSOrigins may call /api/turn from browsers, "*" allows any.
+	TurnCORSOrigins []string
+	// Requests per minute to /api/turn per client IP and per username.
+	TurnRateLimitPerIP   int
+	TurnRateLimitPerUser int
+}
+
+func DefaultConfig() SignalerConfig {
+	return SignalerConfig{
+		Auth:        auth.DefaultConfig(),
+		Policy:      AllowAllPolicy{},
+		RingTimeout: 60 * time.Second,
+		BusyMode:    BusyReject,
+		BusyModes:   map[string]BusyMode{},
+		TurnTTL:     24 * time.Hour,
+		TurnMaxTTL:  24 * time.Hour,
+		ICE:         ICEConfig{STUN: true},
+
+		TurnRateLimitPerIP:   60,
+		TurnRateLimitPerUser: 10,
+	}
 }
 
 type Signaler struct {
-	peers     map[string]Peer
+	peers     map[string]*Peer
+	rooms     map[string]map[string]*Peer
 	turn      *turn.TurnServer
 	expresMap *util.ExpiredMap
 	peerMutex sync.RWMutex
+	verifier  *auth.Verifier
+	policy    Policy
+
+	config       SignalerConfig
+	sessions     map[string]*Session
+	missedCalls  []Session
+	sessionMutex sync.Mutex
+
+	// relays holds the TURN allocations of every user, by relay address.
+	relays     map[string]map[string]*RelayStatus
+	relayMutex sync.RWMutex
+
+	turnIPLimiter   *util.RateLimiter
+	turnUserLimiter *util.RateLimiter
+	// revoked holds the time TURN credentials of a user were revoked, for
+	// as long as credentials issued before may still be valid.
+	revoked *util.ExpiredMap
 }
 
-func NewSignaler(turn *turn.TurnServer) *Signaler {
+func NewSignaler(turn *turn.TurnServer, config SignalerConfig) *Signaler {
+	verifier, err := auth.NewVerifier(config.Auth)
+	if err != nil {
+		logger.Panicf("Failed to load auth keys: %v", err)
+	}
 	var signaler = &Signaler{
-		peers:     make(map[string]Peer),
+		peers:     make(map[string]*Peer),
+		rooms:     make(map[string]map[string]*Peer),
 		turn:      turn,
 		expresMap: util.NewExpiredMap(),
+		verifier:  verifier,
+		policy:    config.Policy,
+		config:    config,
+		sessions:  make(map[string]*Session),
+		relays:    make(map[string]map[string]*RelayStatus),
+
+		turnIPLimiter:   util.NewRateLimiter(config.TurnRateLimitPerIP),
+		turnUserLimiter: util.NewRateLimiter(config.TurnRateLimitPerUser),
+		revoked:         util.NewExpiredMap(),
+	}
+	if len(signaler.config.TurnSecrets) == 0 {
+		signaler.config.TurnSecrets = []string{randomSecret()}
+		logger.Warnf("No [turn] shared_secret, using a random one: credentials are lost on restart and not valid on other instances")
+	}
+	if signaler.config.RingTimeout <= 0 {
+		signaler.config.RingTimeout = DefaultConfig().RingTimeout
+	}
+	if signaler.config.TurnTTL <= 0 {
+		signaler.config.TurnTTL = DefaultConfig().TurnTTL
+	}
+	if signaler.config.TurnMaxTTL < signaler.config.TurnTTL {
+		signaler.config.TurnMaxTTL = signaler.config.TurnTTL
+	}
+	if signaler.turnAPIOpen() {
+		logger.Warnf("TURN credentials endpoint is unauthenticated, set [auth] or [turn] api_keys")
+	}
+	if signaler.policy == nil {
+		signaler.policy = AllowAllPolicy{}
 	}
 	signaler.turn.AuthHandler = signaler.authHandler
+	signaler.turn.EventHandler = signaler.handleAllocationEvent
 	return signaler
 }
 
-func (s Signaler) authHandler(username string, realm string, srcAddr net.Addr) (string, bool) {
-	// handle turn credential.
-	if found, info := s.expresMap.Get(username); found {
-		credential, ok := info.(TurnCredentials)
-		if !ok {
-			logger.Errorf("TURN auth: invalid credential type for username: %s", username)
-			return "", false
+// randomSecret returns a TURN shared secret nobody else knows.
+func randomSecret() string {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		logger.Panicf("Failed to generate a TURN shared secret: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(secret)
+}
+
+// turnPassword is the TURN REST password for |username|:
+// base64(HMAC-SHA1(secret, username)).
+func turnPassword(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// turnUsernameExpiry returns the expiry timestamp a TURN REST username
+// starts with ("timestamp:userid" or just "timestamp").
+func turnUsernameExpiry(username string) (int64, error) {
+	timestamp := username
+	if i := strings.Index(username, ":"); i >= 0 {
+		timestamp = username[:i]
+	}
+	return strconv.ParseInt(timestamp, 10, 64)
+}
+
+// authHandler validates TURN REST credentials statelessly: the username
+// embeds its expiry and the password is recomputed from every active shared
+// secret, so credentials minted before a restart or by another service work.
+func (s *Signaler) authHandler(username string, realm string, srcAddr net.Addr) ([]string, bool) {
+	if s.config.TurnRequireIssued {
+		if found, _ := s.expresMap.Get(username); !found {
+			logger.Warnf("TURN auth: failed - username=%s not issued here (from=%s)", username, srcAddr.String())
+			metrics.TurnAuth.WithLabelValues("failure").Inc()
+			return nil, false
 		}
-		logger.Infof("TURN auth: success for username=%s from=%s", username, srcAddr.String())
-		return credential.Password, true
 	}
-	logger.Warnf("TURN auth: failed - username=%s not found (from=%s)", username, srcAddr.String())
-	return "", false
+	expiry, err := turnUsernameExpiry(username)
+	if err != nil {
+		logger.Warnf("TURN auth: failed - malformed username=%s (from=%s)", username, srcAddr.String())
+		metrics.TurnAuth.WithLabelValues("failure").Inc()
+		return nil, false
+	}
+	if expiry < time.Now().Unix() {
+		logger.Warnf("TURN auth: failed - username=%s expired (from=%s)", username, srcAddr.String())
+		metrics.TurnAuth.WithLabelValues("failure").Inc()
+		return nil, false
+	}
+	if s.turnRevoked(username, expiry) {
+		logger.Warnf("TURN auth: failed - username=%s revoked (from=%s)", username, srcAddr.String())
+		metrics.TurnAuth.WithLabelValues("failure").Inc()
+		return nil, false
+	}
+	passwords := make([]string, 0, len(s.config.TurnSecrets))
+	for _, secret := range s.config.TurnSecrets {
+		passwords = append(passwords, turnPassword(secret, username))
+	}
+	logger.Infof("TURN auth: success for username=%s from=%s", username, srcAddr.String())
+	metrics.TurnAuth.WithLabelValues("success").Inc()
+	return passwords, true
 }
 
-// NotifyPeersUpdate broadcasts the current peer list to all connected peers.
-func (s *Signaler) NotifyPeersUpdate(conn *websocket.WebSocketConn, peers map[string]Peer) {
+// NotifyPeersUpdate broadcasts the peer list of |room| to every peer in that room.
+func (s *Signaler) NotifyPeersUpdate(room string) {
+	if room == "" {
+		return
+	}
 	// Collect data under the lock
 	s.peerMutex.RLock()
-	infos := make([]PeerInfo, 0, len(peers))
-	conns := make([]*websocket.WebSocketConn, 0, len(peers))
-	for _, peer := range peers {
+	members := s.rooms[room]
+	infos := make([]PeerInfo, 0, len(members))
+	conns := make([]*websocket.WebSocketConn, 0, len(members))
+	for _, peer := range members {
 		infos = append(infos, peer.info)
 		conns = append(conns, peer.conn)
 	}
@@ -133,8 +321,22 @@ func (s *Signaler) NotifyPeersUpdate(conn *websocket.WebSocketConn, peers map[st
 // HandleTurnServerCredentials .
 // https://tools.ietf.org/html/draft-uberti-behave-turn-rest-00
 func (s *Signaler) HandleTurnServerCredentials(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "application/json")
-	writer.Header().Set("Access-Control-Allow-Origin", "*")
+	s.allowCORS(writer, request)
+	if request.Method == http.MethodOptions {
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if ok, retryAfter := s.turnIPLimiter.Allow(util.ClientIP(request, nil)); !ok {
+		logger.Warnf("TURN credentials request from %s rate limited", request.RemoteAddr)
+		tooManyRequests(writer, retryAfter)
+		return
+	}
+	subject, ok := s.authorizeTurnRequest(request)
+	if !ok {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	params, err := url.ParseQuery(request.URL.RawQuery)
 	if err != nil {
@@ -153,17 +355,62 @@ func (s *Signaler) HandleTurnServerCredentials(writer http.ResponseWriter, reque
 	}
 
 	usernames, ok := params["username"]
-	if !ok || len(usernames) == 0 {
+	if (!ok || len(usernames) == 0) && len(subject) > 0 {
+		usernames = []string{subject}
+	}
+	if len(usernames) == 0 || len(usernames[0]) == 0 {
 		http.Error(writer, "Missing username parameter", http.StatusBadRequest)
 		return
 	}
 	username := usernames[0]
+	if len(subject) > 0 && username != subject {
+		http.Error(writer, "Username does not match token subject", http.StatusForbidden)
+		return
+	}
+	ttl := s.config.TurnTTL
+	if requested := params.Get("ttl"); len(requested) > 0 {
+		seconds, err := strconv.Atoi(requested)
+		if err != nil || seconds <= 0 {
+			http.Error(writer, "Invalid ttl parameter", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+		if ttl > s.config.TurnMaxTTL {
+			ttl = s.config.TurnMaxTTL
+		}
+	}
+	if s.userRevoked(username) {
+		logger.Warnf("TURN credentials request for revoked user %s refused", username)
+		http.Error(writer, "Credentials revoked", http.StatusForbidden)
+		return
+	}
+	if ok, retryAfter := s.turnUserLimiter.Allow(username); !ok {
+		logger.Warnf("TURN credentials request for %s rate limited", username)
+		tooManyRequests(writer, retryAfter)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
 	logger.Debugf("TURN credentials request: service=%s, username=%s", services[0], username)
-	timestamp := time.Now().Unix()
+	credential := s.issueTurnCredentials(username, ttl)
+	if params.Get("format") == "ice" {
+		json.NewEncoder(writer).Encode(ICEServers{
+			ICEServers: s.iceServers(credential),
+			TTL:        credential.TTL,
+		})
+		return
+	}
+	json.NewEncoder(writer).Encode(credential)
+}
+
+// issueTurnCredentials mints TURN REST credentials for |username|, valid
+// for |lifetime|.
+func (s *Signaler) issueTurnCredentials(username string, lifetime time.Duration) TurnCredentials {
+	now := time.Now()
+	ttl := int(lifetime.Seconds())
+	// The timestamp is the expiry time, as the TURN REST draft specifies.
+	timestamp := now.Unix() + int64(ttl)
 	turnUsername := fmt.Sprintf("%d:%s", timestamp, username)
-	hmac := hmac.New(sha1.New, []byte(sharedKey))
-	hmac.Write([]byte(turnUsername))
-	turnPassword := base64.RawStdEncoding.EncodeToString(hmac.Sum(nil))
+	turnPassword := turnPassword(s.config.TurnSecrets[0], turnUsername)
 	/*
 		{
 		     "username" : "12334939:mbzrxpgjys",
@@ -184,21 +431,51 @@ func (s *Signaler) HandleTurnServerCredentials(writer http.ResponseWriter, reque
 		var config = {"iceServers": [iceServer]};
 		var pc = new RTCPeerConnection(config);
 
+		With format=ice the response is ready to use:
+		var config = {"iceServers": response.iceServers};
 	*/
-	ttl := 86400
-	hostUDP := fmt.Sprintf("%s:%d", s.turn.Config.PublicIP, s.turn.Config.Port)
-	hostTCP := fmt.Sprintf("%s:%d", s.turn.Config.PublicIP, s.turn.Config.PortTCP)
 	credential := TurnCredentials{
 		Username: turnUsername,
 		Password: turnPassword,
 		TTL:      ttl,
-		Uris: []string{
-			"turn:" + hostUDP + "?transport=udp",
-			"turn:" + hostTCP + "?transport=tcp",
-		},
+		Uris:     s.turnURIs(),
 	}
 	s.expresMap.Set(turnUsername, credential, int64(ttl))
-	json.NewEncoder(writer).Encode(credential)
+	metrics.TurnCredentialsIssued.Inc()
+	return credential
+}
+
+// turnHosts lists the configured public addresses of the TURN server.
+func (s *Signaler) turnHosts() []string {
+	config := s.turn.Config
+	hosts := []string{config.PublicIP}
+	if len(config.PublicIPv6) > 0 && config.PublicIPv6 != config.PublicIP {
+		hosts = append(hosts, config.PublicIPv6)
+	}
+	return hosts
+}
+
+// turnURIs lists the turn: and turns: URIs of the enabled TURN listeners,
+// for every configured public address.
+func (s *Signaler) turnURIs() []string {
+	config := s.turn.Config
+	uris := []string{}
+	for _, host := range s.turnHosts() {
+		address := func(port int) string {
+			return net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		uris = append(uris,
+			"turn:"+address(config.Port)+"?transport=udp",
+			"turn:"+address(config.PortTCP)+"?transport=tcp",
+		)
+		if config.PortTLS > 0 {
+			uris = append(uris, "turns:"+address(config.PortTLS)+"?transport=tcp")
+		}
+		if config.PortDTLS > 0 {
+			uris = append(uris, "turns:"+address(config.PortDTLS)+"?transport=udp")
+		}
+	}
+	return uris
 }
 
 func (s *Signaler) Send(conn *websocket.WebSocketConn, m interface{}) error {
@@ -210,10 +487,59 @@ func (s *Signaler) Send(conn *websocket.WebSocketConn, m interface{}) error {
 	return conn.Send(string(data))
 }
 
+// methodLabel bounds the metric label values to the known methods.
+func methodLabel(method Method) string {
+	switch method {
+	case New, Bye, Offer, Answer, Candidate, Leave, Keepalive, Join, LeaveRoom:
+		return string(method)
+	}
+	return "unknown"
+}
+
+// sendError replies to |conn| with an `error` message for |method|.
+func (s *Signaler) sendError(conn *websocket.WebSocketConn, method Method, reason string) {
+	s.sendErrorCode(conn, method, "", reason)
+}
+
+func (s *Signaler) sendErrorCode(conn *websocket.WebSocketConn, method Method, code string, reason string) {
+	msg := Request{
+		Type: "error",
+		Data: Error{
+			Request: string(method),
+			Reason:  reason,
+			Code:    code,
+		},
+	}
+	s.Send(conn, msg)
+}
+
+// authenticate verifies the token of a `new` message, falling back to the
+// one presented on the WebSocket upgrade, and binds its subject to |id|.
+func (s *Signaler) authenticate(id string, token string) (*auth.Claims, error) {
+	claims, err := s.verifier.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject != id {
+		return nil, fmt.Errorf("token subject %q does not match peer id %q", claims.Subject, id)
+	}
+	return claims, nil
+}
+
 func (s *Signaler) HandleNewWebSocket(conn *websocket.WebSocketConn, request *http.Request) {
-	logger.Infof("On Open %v", request)
+	// Only the address and path: the request carries tokens in its
+	// Authorization header and query string.
+	logger.Infof("On Open %s %s", request.RemoteAddr, request.URL.Path)
+	upgradeToken := auth.TokenFromRequest(request)
+	remoteAddr := request.RemoteAddr
+	connectedAt := time.Now()
+	// Binary frames only carry messages with the codec of
+	// websocket.DeflateSubprotocol, which conn decodes.
+	conn.On("binary", func(message []byte) {
+		logger.Warnf("Binary frame from %s without a codec", remoteAddr)
+		s.sendError(conn, "", "Binary frames need the "+websocket.DeflateSubprotocol+" subprotocol")
+	})
 	conn.On("message", func(message []byte) {
-		logger.Infof("On message %v", string(message))
 		var body json.RawMessage
 		request := Request{
 			Data: &body,
@@ -223,6 +549,8 @@ func (s *Signaler) HandleNewWebSocket(conn *websocket.WebSocketConn, request *ht
 			logger.Errorf("Unmarshal error %v", err)
 			return
 		}
+		// Payloads may carry tokens, so only the method is logged.
+		logger.Infof("On message %s (%d bytes)", request.Type, len(message))
 
 		var data map[string]interface{}
 		err = json.Unmarshal(body, &data)
@@ -231,6 +559,8 @@ func (s *Signaler) HandleNewWebSocket(conn *websocket.WebSocketConn, request *ht
 			return
 		}
 
+		metrics.Messages.WithLabelValues(methodLabel(request.Type)).Inc()
+
 		switch request.Type {
 		case New:
 			var info PeerInfo
@@ -239,19 +569,113 @@ func (s *Signaler) HandleNewWebSocket(conn *websocket.WebSocketConn, request *ht
 				logger.Errorf("Unmarshal login error %v", err)
 				return
 			}
+			var claims *auth.Claims
+			if s.verifier.Enabled() {
+				var registration Registration
+				json.Unmarshal(body, &registration)
+				token := registration.Token
+				if token == "" {
+					token = upgradeToken
+				}
+				claims, err = s.authenticate(info.ID, token)
+				if err != nil {
+					logger.Warnf("Rejecting registration of peer %s: %v", info.ID, err)
+					s.sendErrorCode(conn, request.Type, ErrorUnauthorized, "Authentication failed")
+					return
+				}
+			}
+			room := info.Room
+			if room == "" {
+				room = DefaultRoom
+			}
+			peer := &Peer{
+				conn:        conn,
+				info:        info,
+				claims:      claims,
+				remoteAddr:  remoteAddr,
+				connectedAt: connectedAt,
+			}
+			if !peer.mayEnter(room) {
+				logger.Warnf("Rejecting registration of peer %s: not allowed in room %s", info.ID, room)
+				s.sendErrorCode(conn, request.Type, ErrorForbidden, "Not allowed to join room ["+room+"]")
+				return
+			}
 			s.peerMutex.Lock()
-			if existing, exists := s.peers[info.ID]; exists {
+			var evictedRoom string
+			existing, evicted := s.peers[info.ID]
+			if evicted {
 				// Close the old connection if a peer re-registers with the same ID
 				logger.Warnf("Peer %s re-registering, closing old connection", info.ID)
+				evictedRoom = s.moveToRoomLocked(existing, "")
+				stopICERefreshLocked(existing)
 				go existing.conn.Close()
 			}
-			s.peers[info.ID] = Peer{
-				conn: conn,
-				info: info,
-			}
+			s.peers[info.ID] = peer
+			metrics.PeersConnected.Set(float64(len(s.peers)))
+			s.moveToRoomLocked(peer, room)
 			s.peerMutex.Unlock()
-			s.NotifyPeersUpdate(conn, s.peers)
+			if evicted {
+				// The close handler of the old connection no longer finds
+				// it, so its calls are hung up here.
+				s.hangupPeer(info.ID, EndDisconnected)
+			}
+			s.pushICEServers(peer)
+			if evictedRoom != "" && evictedRoom != room {
+				s.notifyLeave(evictedRoom, info.ID)
+				s.NotifyPeersUpdate(evictedRoom)
+			}
+			s.NotifyPeersUpdate(room)
 			break
+		case Join:
+			var join RoomRequest
+			err := json.Unmarshal(body, &join)
+			if err != nil || join.Room == "" {
+				s.sendError(conn, request.Type, "Invalid room")
+				return
+			}
+			s.peerMutex.Lock()
+			self := s.peerForConnLocked(conn)
+			if self == nil {
+				s.peerMutex.Unlock()
+				s.sendError(conn, request.Type, "Peer not registered")
+				return
+			}
+			id := self.info.ID
+			if !self.mayEnter(join.Room) {
+				s.peerMutex.Unlock()
+				logger.Warnf("Peer %s may not join room %s", id, join.Room)
+				s.sendErrorCode(conn, request.Type, ErrorForbidden, "Not allowed to join room ["+join.Room+"]")
+				return
+			}
+			prev := s.moveToRoomLocked(self, join.Room)
+			s.peerMutex.Unlock()
+			if prev != join.Room {
+				s.notifyLeave(prev, id)
+				s.NotifyPeersUpdate(prev)
+			}
+			logger.Infof("Peer %s joined room %s", id, join.Room)
+			s.NotifyPeersUpdate(join.Room)
+		case LeaveRoom:
+			s.peerMutex.Lock()
+			self := s.peerForConnLocked(conn)
+			if self == nil {
+				s.peerMutex.Unlock()
+				s.sendError(conn, request.Type, "Peer not registered")
+				return
+			}
+			id := self.info.ID
+			prev := s.moveToRoomLocked(self, "")
+			s.peerMutex.Unlock()
+			if prev != "" {
+				logger.Infof("Peer %s left room %s", id, prev)
+				s.notifyLeave(prev, id)
+				s.NotifyPeersUpdate(prev)
+			}
+			// Outside of a room the peer sees nobody.
+			s.Send(conn, Request{
+				Type: "peers",
+				Data: []PeerInfo{},
+			})
 		case Leave:
 		case Offer:
 			fallthrough
@@ -265,21 +689,43 @@ func (s *Signaler) HandleNewWebSocket(conn *websocket.WebSocketConn, request *ht
 					logger.Errorf("Unmarshal "+string(request.Type)+" got error %v", err)
 					return
 				}
+				self, ok := s.peerForConn(conn)
+				if !ok {
+					s.sendError(conn, request.Type, "Peer not registered")
+					return
+				}
 				to := negotiation.To
-				s.peerMutex.RLock()
-				peer, ok := s.peers[to]
-				s.peerMutex.RUnlock()
+				peer, ok := s.peerInRoom(self.room, to)
 				if !ok {
-					msg := Request{
-						Type: "error",
-						Data: Error{
-							Request: string(request.Type),
-							Reason:  "Peer [" + to + "] not found ",
-						},
-					}
-					s.Send(conn, msg)
+					metrics.ForwardFailures.WithLabelValues(string(request.Type)).Inc()
+					s.sendError(conn, request.Type, "Peer ["+to+"] not found ")
 					return
 				}
+				if !s.policy.Allow(request.Type, self.subject(), peer.subject()) {
+					logger.Warnf("Policy denied %s from %s to %s", request.Type, self.info.ID, to)
+					s.sendErrorCode(conn, request.Type, ErrorForbidden, "Not allowed to reach peer ["+to+"]")
+					return
+				}
+				if negotiation.SessionID == "" {
+					s.sendError(conn, request.Type, "Missing session_id")
+					return
+				}
+				mode := s.busyMode(peer.subject().Role)
+				err = s.advanceSession(request.Type, negotiation, self.info.ID, mode)
+				if err == errPeerBusy {
+					logger.Infof("Session %s: %s is busy, rejecting offer from %s", negotiation.SessionID, to, self.info.ID)
+					s.rejectBusy(self, peer, negotiation, mode)
+					return
+				}
+				if err != nil {
+					logger.Warnf("Session %s: rejecting %s from %s: %v", negotiation.SessionID, request.Type, self.info.ID, err)
+					s.sendErrorCode(conn, request.Type, ErrorInvalidState, "Session ["+negotiation.SessionID+"]: "+err.Error())
+					return
+				}
+				// The callee learns the sender from the server, never from
+				// what the client claims.
+				data["from"] = self.info.ID
+				request.Data = data
 				s.Send(peer.conn, request)
 			}
 			break
@@ -291,45 +737,57 @@ func (s *Signaler) HandleNewWebSocket(conn *websocket.WebSocketConn, request *ht
 				return
 			}
 
-			ids := strings.Split(bye.SessionID, "~")
-			if len(ids) != 2 {
-				msg := Request{
-					Type: "error",
-					Data: Error{
-						Request: string(request.Type),
-						Reason:  "Invalid session [" + bye.SessionID + "]",
-					},
-				}
-				s.Send(conn, msg)
+			self, ok := s.peerForConn(conn)
+			if !ok {
+				s.sendError(conn, request.Type, "Peer not registered")
 				return
 			}
+			reason := bye.Reason
+			if reason == "" {
+				reason = EndHangup
+			}
 
-			// Determine the remote peer (the one that is NOT the sender)
-			remoteID := ids[0]
-			if ids[0] == bye.From {
-				remoteID = ids[1]
+			// Sessions known to the registry are ended by their recorded
+			// parties, wherever they are now; otherwise fall back to the
+			// "a~b" session id convention within the sender's room.
+			var remoteID string
+			session, err := s.endSession(bye.SessionID, self.info.ID, reason)
+			switch err {
+			case nil:
+				logger.Infof("Session %s ended by %s (%s)", session.ID, self.info.ID, reason)
+				s.sendBye(session, self.info.ID, session.other(self.info.ID))
+				return
+			case errSessionNotParty:
+				logger.Warnf("Session %s: rejecting bye from %s: %v", bye.SessionID, self.info.ID, err)
+				s.sendErrorCode(conn, request.Type, ErrorForbidden, "Session ["+bye.SessionID+"]: "+err.Error())
+				return
+			default:
+				ids := strings.Split(bye.SessionID, "~")
+				if len(ids) != 2 || (ids[0] != self.info.ID && ids[1] != self.info.ID) {
+					s.sendError(conn, request.Type, "Invalid session ["+bye.SessionID+"]")
+					return
+				}
+
+				// Determine the remote peer (the one that is NOT the sender)
+				remoteID = ids[0]
+				if ids[0] == self.info.ID {
+					remoteID = ids[1]
+				}
 			}
 
-			s.peerMutex.RLock()
-			remotePeer, ok := s.peers[remoteID]
-			s.peerMutex.RUnlock()
+			remotePeer, ok := s.peerInRoom(self.room, remoteID)
 
 			if !ok {
-				msg := Request{
-					Type: "error",
-					Data: Error{
-						Request: string(request.Type),
-						Reason:  "Peer [" + remoteID + "] not found.",
-					},
-				}
-				s.Send(conn, msg)
+				metrics.ForwardFailures.WithLabelValues(string(request.Type)).Inc()
+				s.sendError(conn, request.Type, "Peer ["+remoteID+"] not found.")
 			} else {
 				byeMsg := Request{
 					Type: "bye",
 					Data: map[string]interface{}{
-						"from":       bye.From,
+						"from":       self.info.ID,
 						"to":         remoteID,
 						"session_id": bye.SessionID,
+						"reason":     reason,
 					},
 				}
 				s.Send(remotePeer.conn, byeMsg)
@@ -338,50 +796,98 @@ func (s *Signaler) HandleNewWebSocket(conn *websocket.WebSocketConn, request *ht
 		case Keepalive:
 			s.Send(conn, request)
 		default:
-			logger.Warnf("Unknown request %v", request)
+			logger.Warnf("Unknown request %s", request.Type)
 		}
 	})
 
 	conn.On("close", func(code int, text string) {
-		logger.Infof("On Close %v", conn)
+		logger.Infof("On Close %s (%d %s)", remoteAddr, code, text)
 
 		// Find and remove the peer atomically under a single write lock
 		s.peerMutex.Lock()
-		var peerID string
-		for _, peer := range s.peers {
-			if peer.conn == conn {
-				peerID = peer.info.ID
-				break
-			}
-		}
-		if peerID == "" {
+		peer := s.peerForConnLocked(conn)
+		if peer == nil {
 			s.peerMutex.Unlock()
 			logger.Warnf("Close event for unknown peer connection")
 			return
 		}
+		peerID := peer.info.ID
 		delete(s.peers, peerID)
-
-		// Collect remaining peer connections while still holding the lock
-		remainingPeers := make([]Peer, 0, len(s.peers))
-		for _, peer := range s.peers {
-			remainingPeers = append(remainingPeers, peer)
-		}
+		metrics.PeersConnected.Set(float64(len(s.peers)))
+		room := s.moveToRoomLocked(peer, "")
+		stopICERefreshLocked(peer)
 		s.peerMutex.Unlock()
 
 		logger.Infof("Peer %s disconnected", peerID)
 
-		// Notify other peers outside the lock to avoid blocking
-		for _, peer := range remainingPeers {
-			leave := Request{
-				Type: "leave",
-				Data: map[string]interface{}{
-					"id": peerID,
-				},
-			}
-			s.Send(peer.conn, leave)
-		}
+		// Hang up calls the peer was in so the other side is not left waiting
+		s.hangupPeer(peerID, EndDisconnected)
 
-		// Notify all remaining peers of the updated peer list
-		s.NotifyPeersUpdate(conn, s.peers)
+		// Notify the rest of the room outside the lock to avoid blocking
+		s.notifyLeave(room, peerID)
+		s.NotifyPeersUpdate(room)
 	})
 }
+
+// Shutdown tells every peer that the server is going away, waits until the
+// active sessions have ended or |ctx| is done, then disconnects the peers
+// that are left, waiting for their last messages to be written within the
+// same |ctx|, and stops the credential expiry.
+func (s *Signaler) Shutdown(ctx context.Context) {
+	reconnectAfter := 0
+	if deadline, ok := ctx.Deadline(); ok {
+		reconnectAfter = int(time.Until(deadline).Seconds())
+	}
+	s.peerMutex.RLock()
+	conns := make([]*websocket.WebSocketConn, 0, len(s.peers))
+	for _, peer := range s.peers {
+		conns = append(conns, peer.conn)
+	}
+	s.peerMutex.RUnlock()
+
+	logger.Infof("Shutting down, draining %d peers", len(conns))
+	notice := Request{
+		Type: ServerShutdown,
+		Data: map[string]interface{}{
+			"reconnect_after": reconnectAfter,
+		},
+	}
+	for _, c := range conns {
+		s.Send(c, notice)
+	}
+
+	s.waitForSessions(ctx)
+	for _, c := range conns {
+		c.Close()
+	}
+	waitForWriters(ctx, conns)
+	s.expresMap.Close()
+	s.revoked.Close()
+}
+
+// waitForWriters blocks until |conns| have flushed their last messages and
+// closed, or |ctx| is done.
+func waitForWriters(ctx context.Context, conns []*websocket.WebSocketConn) {
+	for _, c := range conns {
+		select {
+		case <-c.Done():
+		case <-ctx.Done():
+			logger.Warnf("Drain window over with connections still flushing")
+			return
+		}
+	}
+}
+
+// waitForSessions blocks until no session is active or |ctx| is done.
+func (s *Signaler) waitForSessions(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for len(s.Sessions()) > 0 {
+		select {
+		case <-ctx.Done():
+			logger.Warnf("Drain window over with %d sessions active", len(s.Sessions()))
+			return
+		case <-ticker.C:
+		}
+	}
+}
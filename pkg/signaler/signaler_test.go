@@ -0,0 +1,211 @@
+package signaler
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/turn"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/websocket"
+	gorilla "github.com/gorilla/websocket"
+)
+
+// testClient is a peer connected to a test server.
+type testClient struct {
+	t        *testing.T
+	socket   *gorilla.Conn
+	messages chan Request
+	// err is the read error that ended messages.
+	err error
+}
+
+// newTestServer serves a new Signaler with |config| until the test ends.
+func newTestServer(t *testing.T, config SignalerConfig) (*Signaler, *httptest.Server) {
+	t.Helper()
+	s := NewSignaler(&turn.TurnServer{Config: turn.DefaultConfig()}, config)
+	wsServer := websocket.NewWebSocketServer(websocket.DefaultConfig(), s.HandleNewWebSocket, nil, nil)
+	server := httptest.NewServer(wsServer.Handler())
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func dial(t *testing.T, server *httptest.Server, id string) *testClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + websocket.DefaultConfig().WebSocketPath
+	socket, _, err := gorilla.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &testClient{t: t, socket: socket, messages: make(chan Request, 64)}
+	go func() {
+		defer close(client.messages)
+		for {
+			var message Request
+			if err := socket.ReadJSON(&message); err != nil {
+				client.err = err
+				return
+			}
+			client.messages <- message
+		}
+	}()
+	client.send(New, PeerInfo{ID: id, Name: id})
+	return client
+}
+
+func (c *testClient) send(method Method, data interface{}) {
+	c.t.Helper()
+	if err := c.socket.WriteJSON(Request{Type: method, Data: data}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect returns the data of the next |method| message, skipping the
+// unsolicited ones.
+func (c *testClient) expect(method Method) map[string]interface{} {
+	c.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case message, ok := <-c.messages:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %s", method)
+			}
+			if message.Type == method {
+				data, _ := message.Data.(map[string]interface{})
+				return data
+			}
+			switch message.Type {
+			case "peers", "leave", ICEServersMethod, Keepalive:
+				continue
+			}
+			c.t.Fatalf("got %s %v, want %s", message.Type, message.Data, method)
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %s", method)
+		}
+	}
+}
+
+// waitFor polls |done| until it holds or a few seconds have passed.
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !done(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHangupOnDisconnect(t *testing.T) {
+	tests := []struct {
+		name       string
+		disconnect func(t *testing.T, server *httptest.Server, b *testClient) *testClient
+	}{
+		{"close", func(t *testing.T, server *httptest.Server, b *testClient) *testClient {
+			b.socket.Close()
+			return nil
+		}},
+		{"re-register", func(t *testing.T, server *httptest.Server, b *testClient) *testClient {
+			return dial(t, server, "b")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, server := newTestServer(t, DefaultConfig())
+
+			a := dial(t, server, "a")
+			defer a.socket.Close()
+			b := dial(t, server, "b")
+			defer b.socket.Close()
+			waitFor(t, "registration", func() bool { return len(s.Peers()) == 2 })
+
+			a.send(Offer, map[string]interface{}{"from": "mallory", "to": "b", "session_id": "a~b"})
+			if from := b.expect(Offer)["from"]; from != "a" {
+				t.Errorf("offer forwarded from %v, want a", from)
+			}
+			b.send(Answer, map[string]interface{}{"to": "a", "session_id": "a~b"})
+			a.expect(Answer)
+
+			if b2 := test.disconnect(t, server, b); b2 != nil {
+				defer b2.socket.Close()
+			}
+			bye := a.expect(Bye)
+			if bye["session_id"] != "a~b" || bye["from"] != "b" || bye["reason"] != EndDisconnected {
+				t.Errorf("bye is %v", bye)
+			}
+			if sessions := s.Sessions(); len(sessions) != 0 {
+				t.Errorf("sessions left: %+v", sessions)
+			}
+		})
+	}
+}
+
+func TestEvictedPeerIsNotBusy(t *testing.T) {
+	s, server := newTestServer(t, DefaultConfig())
+
+	a := dial(t, server, "a")
+	defer a.socket.Close()
+	b := dial(t, server, "b")
+	defer b.socket.Close()
+	c := dial(t, server, "c")
+	defer c.socket.Close()
+	waitFor(t, "registration", func() bool { return len(s.Peers()) == 3 })
+
+	a.send(Offer, map[string]interface{}{"to": "b", "session_id": "a~b"})
+	b.expect(Offer)
+
+	b2 := dial(t, server, "b")
+	defer b2.socket.Close()
+	a.expect(Bye)
+
+	c.send(Offer, map[string]interface{}{"to": "b", "session_id": "c~b"})
+	if from := b2.expect(Offer)["from"]; from != "c" {
+		t.Errorf("offer forwarded from %v, want c", from)
+	}
+}
+
+func TestByeAfterRoomChange(t *testing.T) {
+	s, server := newTestServer(t, DefaultConfig())
+
+	a := dial(t, server, "a")
+	defer a.socket.Close()
+	b := dial(t, server, "b")
+	defer b.socket.Close()
+	waitFor(t, "registration", func() bool { return len(s.Peers()) == 2 })
+
+	a.send(Offer, map[string]interface{}{"to": "b", "session_id": "a~b"})
+	b.expect(Offer)
+	b.send(Answer, map[string]interface{}{"to": "a", "session_id": "a~b"})
+	a.expect(Answer)
+
+	b.send(Join, map[string]interface{}{"room": "other"})
+	waitFor(t, "room change", func() bool {
+		s.peerMutex.RLock()
+		defer s.peerMutex.RUnlock()
+		return s.peers["b"].room == "other"
+	})
+	a.send(Bye, map[string]interface{}{"session_id": "a~b"})
+	if from := b.expect(Bye)["from"]; from != "a" {
+		t.Errorf("bye forwarded from %v, want a", from)
+	}
+}
+
+func TestShutdownClosesCleanly(t *testing.T) {
+	s, server := newTestServer(t, DefaultConfig())
+	a := dial(t, server, "a")
+	defer a.socket.Close()
+	waitFor(t, "registration", func() bool { return len(s.Peers()) == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.Shutdown(ctx)
+
+	a.expect(ServerShutdown)
+	for range a.messages {
+	}
+	if !gorilla.IsCloseError(a.err, gorilla.CloseNormalClosure) {
+		t.Errorf("connection ended with %v, want a normal close", a.err)
+	}
+}
@@ -0,0 +1,123 @@
+package signaler
+
+import (
+	"crypto/subtle"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/auth"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/turn"
+)
+
+// turnAPIOpen reports whether /api/turn accepts anonymous requests, which
+// is the case when neither JWTs nor API keys are configured.
+func (s *Signaler) turnAPIOpen() bool {
+	return !s.verifier.Enabled() && len(s.config.TurnAPIKeys) == 0
+}
+
+// authorizeTurnRequest checks the API key or JWT of a credentials request.
+// For JWTs it returns the subject, which credentials may only be minted for.
+func (s *Signaler) authorizeTurnRequest(request *http.Request) (string, bool) {
+	if s.turnAPIOpen() {
+		return "", true
+	}
+	token := auth.TokenFromRequest(request)
+	if key := request.Header.Get("X-API-Key"); len(key) > 0 {
+		token = key
+	}
+	if len(token) == 0 {
+		return "", false
+	}
+	for _, key := range s.config.TurnAPIKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			return "", true
+		}
+	}
+	if !s.verifier.Enabled() {
+		return "", false
+	}
+	claims, err := s.verifier.Verify(token)
+	if err != nil {
+		logger.Warnf("TURN credentials request from %s: %v", request.RemoteAddr, err)
+		return "", false
+	}
+	return claims.Subject, true
+}
+
+// allowCORS answers cross-origin requests from the configured origins.
+func (s *Signaler) allowCORS(writer http.ResponseWriter, request *http.Request) {
+	origin := request.Header.Get("Origin")
+	if len(origin) == 0 {
+		return
+	}
+	for _, allowed := range s.config.TurnCORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			writer.Header().Set("Access-Control-Allow-Origin", origin)
+			writer.Header().Set("Access-Control-Allow-Headers", "Authorization, X-API-Key")
+			writer.Header().Add("Vary", "Origin")
+			return
+		}
+	}
+}
+
+func tooManyRequests(writer http.ResponseWriter, retryAfter time.Duration) {
+	writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(writer, "Too many requests", http.StatusTooManyRequests)
+}
+
+// RevokeTurnCredentials invalidates every TURN credential issued to |user|
+// so far, closes its allocations and stops pushing ice_servers to it.
+// Credentials are stateless, so none are minted for |user| until the ones
+// that may have been issued before now have expired, at the time returned,
+// or until RestoreTurnCredentials is called.
+func (s *Signaler) RevokeTurnCredentials(user string) (int, time.Time) {
+	now := time.Now()
+	s.revoked.Set(user, now, int64(s.config.TurnMaxTTL.Seconds())+1)
+	s.peerMutex.Lock()
+	if peer, ok := s.peers[user]; ok {
+		stopICERefreshLocked(peer)
+	}
+	s.peerMutex.Unlock()
+	logger.Warnf("Admin: revoked TURN credentials of %s", user)
+	return s.turn.CloseAllocations(user), now.Add(s.config.TurnMaxTTL)
+}
+
+// RestoreTurnCredentials lifts the revocation of |user|: its credentials
+// are accepted and minted again, and ice_servers are pushed to it if it is
+// connected. It reports whether |user| was revoked.
+func (s *Signaler) RestoreTurnCredentials(user string) bool {
+	if !s.userRevoked(user) {
+		return false
+	}
+	s.revoked.Delete(user)
+	logger.Warnf("Admin: restored TURN credentials of %s", user)
+	s.peerMutex.RLock()
+	peer, ok := s.peers[user]
+	s.peerMutex.RUnlock()
+	if ok {
+		s.pushICEServers(peer)
+	}
+	return true
+}
+
+// userRevoked reports whether |user| was revoked within the last
+// TurnMaxTTL, during which no credentials are minted for it.
+func (s *Signaler) userRevoked(user string) bool {
+	found, _ := s.revoked.Get(user)
+	return found
+}
+
+// turnRevoked reports whether |username|, expiring at |expiry|, belongs to
+// a user whose credentials were revoked after it could have been issued.
+func (s *Signaler) turnRevoked(username string, expiry int64) bool {
+	found, value := s.revoked.Get(turn.UsernameUser(username))
+	if !found {
+		return false
+	}
+	revokedAt := value.(time.Time)
+	return expiry <= revokedAt.Add(s.config.TurnMaxTTL).Unix()
+}
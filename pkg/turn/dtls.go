@@ -0,0 +1,129 @@
+package turn
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/protocol"
+	"github.com/pion/dtls/v2/pkg/protocol/recordlayer"
+	"github.com/pion/transport/v2/udp"
+)
+
+const (
+	// dtlsHandshakeTimeout bounds the handshake of a single DTLS client.
+	dtlsHandshakeTimeout = 5 * time.Second
+	// dtlsMaxHandshakes caps the handshakes in progress; clients arriving
+	// beyond it are dropped and have to retry.
+	dtlsMaxHandshakes = 256
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+// asyncDTLSListener runs every DTLS handshake in a goroutine of its own and
+// only hands finished ones to Accept. pion's dtls.Listen handshakes inside
+// Accept, so one client that never completes it, from a spoofable address,
+// would hold up every other client of the listener.
+type asyncDTLSListener struct {
+	parent    net.Listener
+	config    *dtls.Config
+	accepted  chan net.Conn
+	pending   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func listenDTLS(network string, address *net.UDPAddr, config *dtls.Config) (net.Listener, error) {
+	config.ConnectContextMaker = func() (context.Context, func()) {
+		return context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+	}
+	listenConfig := udp.ListenConfig{
+		// Only a handshake record can open a connection, as in dtls.Listen
+		AcceptFilter: func(packet []byte) bool {
+			records, err := recordlayer.UnpackDatagram(packet)
+			if err != nil || len(records) < 1 {
+				return false
+			}
+			header := &recordlayer.Header{}
+			if err := header.Unmarshal(records[0]); err != nil {
+				return false
+			}
+			return header.ContentType == protocol.ContentTypeHandshake
+		},
+	}
+	parent, err := listenConfig.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return newAsyncDTLSListener(parent, config), nil
+}
+
+func newAsyncDTLSListener(parent net.Listener, config *dtls.Config) *asyncDTLSListener {
+	l := &asyncDTLSListener{
+		parent:   parent,
+		config:   config,
+		accepted: make(chan net.Conn),
+		pending:  make(chan struct{}, dtlsMaxHandshakes),
+		closed:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *asyncDTLSListener) run() {
+	for {
+		conn, err := l.parent.Accept()
+		if err != nil {
+			l.Close()
+			return
+		}
+		select {
+		case l.pending <- struct{}{}:
+			go l.handshake(conn)
+		default:
+			logger.Warnf("TURN: %d DTLS handshakes in progress, dropping %s", dtlsMaxHandshakes, conn.RemoteAddr())
+			conn.Close()
+		}
+	}
+}
+
+func (l *asyncDTLSListener) handshake(conn net.Conn) {
+	dtlsConn, err := dtls.Server(conn, l.config)
+	<-l.pending
+	if err != nil {
+		logger.Debugf("TURN: DTLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	select {
+	case l.accepted <- dtlsConn:
+	case <-l.closed:
+		dtlsConn.Close()
+	}
+}
+
+func (l *asyncDTLSListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *asyncDTLSListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.parent.Close()
+	})
+	return err
+}
+
+func (l *asyncDTLSListener) Addr() net.Addr {
+	return l.parent.Addr()
+}
@@ -0,0 +1,124 @@
+package turn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/turn/v2"
+)
+
+// writeCertificate writes a self-signed certificate and its key to |dir|.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func freeUDPPort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestDTLSStalledHandshake(t *testing.T) {
+	config := DefaultConfig()
+	config.Port, config.PortTCP = 0, 0
+	config.PortDTLS = freeUDPPort(t)
+	config.CertFile, config.KeyFile = writeCertificate(t, t.TempDir())
+	server := NewTurnServer(config)
+	defer server.Close()
+	server.AuthHandler = func(username string, realm string, srcAddr net.Addr) ([]string, bool) {
+		return []string{"secret"}, true
+	}
+	serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: config.PortDTLS}
+
+	// A handshake record that never leads anywhere
+	staller, err := net.DialUDP("udp4", nil, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staller.Close()
+	record := []byte{22, 0xfe, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0}
+	if _, err := staller.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := dtls.Dial("udp4", serverAddr, &dtls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		client, err := turn.NewClient(&turn.ClientConfig{
+			TURNServerAddr: serverAddr.String(),
+			Username:       "1:alice",
+			Password:       "secret",
+			Realm:          config.Realm,
+			Conn:           turn.NewSTUNConn(conn),
+		})
+		if err != nil {
+			done <- err
+			return
+		}
+		defer client.Close()
+		if err := client.Listen(); err != nil {
+			done <- err
+			return
+		}
+		relay, err := client.Allocate()
+		if err == nil {
+			relay.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("allocation over DTLS failed: %v", err)
+		}
+	case <-time.After(dtlsHandshakeTimeout / 2):
+		t.Fatal("allocation over DTLS held up by a stalled handshake")
+	}
+}
@@ -0,0 +1,142 @@
+package turn
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+type AllocationEventType string
+
+const (
+	AllocationCreated   AllocationEventType = "allocation_created"
+	AllocationRefreshed AllocationEventType = "allocation_refreshed"
+	AllocationDeleted   AllocationEventType = "allocation_deleted"
+	PermissionCreated   AllocationEventType = "permission_created"
+)
+
+// AllocationEvent describes a change to the allocation of a client.
+type AllocationEvent struct {
+	Type       AllocationEventType
+	Username   string
+	ClientAddr net.Addr
+	RelayAddr  net.Addr
+	// PeerAddr is set for PermissionCreated.
+	PeerAddr net.Addr
+	// Lifetime is set for AllocationCreated and AllocationRefreshed.
+	Lifetime time.Duration
+}
+
+func (s *TurnServer) notify(event AllocationEvent) {
+	if s.EventHandler != nil {
+		s.EventHandler(event)
+	}
+}
+
+// lifetime reads the LIFETIME attribute of |message|.
+func lifetime(message *stun.Message) time.Duration {
+	value, err := message.Get(stun.AttrLifetime)
+	if err != nil || len(value) != 4 {
+		return 0
+	}
+	return time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+}
+
+// peerAddrs reads every XOR-PEER-ADDRESS attribute of |message|.
+func peerAddrs(message *stun.Message) []net.Addr {
+	var peers []net.Addr
+	for _, attribute := range message.Attributes {
+		if attribute.Type != stun.AttrXORPeerAddress {
+			continue
+		}
+		single := &stun.Message{
+			TransactionID: message.TransactionID,
+			Attributes:    stun.Attributes{attribute},
+		}
+		var peer stun.XORMappedAddress
+		if err := peer.GetFromAs(single, stun.AttrXORPeerAddress); err == nil {
+			peers = append(peers, &net.UDPAddr{IP: peer.IP, Port: peer.Port})
+		}
+	}
+	return peers
+}
+
+// observeResponse follows the success responses the server sends to
+// |clientAddr|: allocations learn their owner from the Allocate response and
+// refreshes and permissions are reported to the EventHandler. The matching
+// request is found by transaction ID among the recorded ones.
+func (s *TurnServer) observeResponse(clientAddr net.Addr, raw []byte) {
+	if !stun.IsMessage(raw) {
+		return
+	}
+	// Most writes relay data, so look at the type before copying anything.
+	var messageType stun.MessageType
+	messageType.ReadValue(binary.BigEndian.Uint16(raw[0:2]))
+	if messageType.Class != stun.ClassSuccessResponse {
+		return
+	}
+	switch messageType.Method {
+	case stun.MethodAllocate, stun.MethodRefresh, stun.MethodCreatePermission, stun.MethodChannelBind:
+	default:
+		return
+	}
+	message := &stun.Message{Raw: append([]byte{}, raw...)}
+	if err := message.Decode(); err != nil {
+		return
+	}
+	request, ok := s.recorder.request(clientAddr, message.TransactionID)
+	if !ok {
+		return
+	}
+	var username stun.Username
+	if err := username.GetFrom(request); err != nil {
+		return
+	}
+
+	switch message.Type.Method {
+	case stun.MethodAllocate:
+		var relayed stun.XORMappedAddress
+		if err := relayed.GetFromAs(message, stun.AttrXORRelayedAddress); err != nil {
+			return
+		}
+		relayAddr := &net.UDPAddr{IP: relayed.IP, Port: relayed.Port}
+		if a, ok := s.tracker.assign(relayAddr.String(), clientAddr, username.String()); ok {
+			s.notify(AllocationEvent{
+				Type:       AllocationCreated,
+				Username:   a.username,
+				ClientAddr: clientAddr,
+				RelayAddr:  a.relayAddr,
+				Lifetime:   lifetime(message),
+			})
+		}
+	case stun.MethodRefresh:
+		// A zero lifetime deletes the allocation, reported when its relay
+		// is closed.
+		remaining := lifetime(message)
+		if remaining == 0 {
+			return
+		}
+		if a, ok := s.tracker.byClientAddr(clientAddr); ok {
+			s.notify(AllocationEvent{
+				Type:       AllocationRefreshed,
+				Username:   a.username,
+				ClientAddr: clientAddr,
+				RelayAddr:  a.relayAddr,
+				Lifetime:   remaining,
+			})
+		}
+	case stun.MethodCreatePermission, stun.MethodChannelBind:
+		a, added := s.tracker.permit(clientAddr, peerAddrs(request))
+		for _, peer := range added {
+			s.notify(AllocationEvent{
+				Type:       PermissionCreated,
+				Username:   a.username,
+				ClientAddr: clientAddr,
+				RelayAddr:  a.relayAddr,
+				PeerAddr:   peer,
+			})
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package turn
+
+import (
+	"net"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/metrics"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/util"
+)
+
+// DefaultDeniedPeers keeps relays from reaching the networks around the
+// server: private ranges, loopback, link-local (which includes the cloud
+// metadata service at 169.254.169.254) and their IPv6 counterparts.
+var DefaultDeniedPeers = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// peerFilter decides which peer addresses clients may create permissions and
+// channel bindings for. Allowed networks take precedence over denied ones.
+type peerFilter struct {
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+}
+
+func (f *peerFilter) permit(clientAddr net.Addr, peerIP net.IP) bool {
+	if ip4 := peerIP.To4(); ip4 != nil {
+		peerIP = ip4
+	}
+	if util.ContainsIP(f.allowed, peerIP) || !util.ContainsIP(f.denied, peerIP) {
+		return true
+	}
+	logger.Warnf("TURN: denied relay from %s to %s", clientAddr, peerIP)
+	metrics.TurnPermissionsDenied.Inc()
+	return false
+}
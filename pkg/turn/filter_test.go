@@ -0,0 +1,51 @@
+package turn
+
+import (
+	"net"
+	"testing"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/util"
+)
+
+func TestPeerFilterPermit(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		denied  []string
+		peer    string
+		want    bool
+	}{
+		{"public IPv4", nil, DefaultDeniedPeers, "203.0.113.7", true},
+		{"private IPv4", nil, DefaultDeniedPeers, "10.1.2.3", false},
+		{"loopback", nil, DefaultDeniedPeers, "127.0.0.1", false},
+		{"metadata service", nil, DefaultDeniedPeers, "169.254.169.254", false},
+		{"carrier-grade NAT", nil, DefaultDeniedPeers, "100.64.0.1", false},
+		{"IPv4-mapped private", nil, DefaultDeniedPeers, "::ffff:192.168.1.1", false},
+		{"IPv4-mapped public", nil, DefaultDeniedPeers, "::ffff:203.0.113.7", true},
+		{"public IPv6", nil, DefaultDeniedPeers, "2001:db8::1", true},
+		{"IPv6 loopback", nil, DefaultDeniedPeers, "::1", false},
+		{"IPv6 unique local", nil, DefaultDeniedPeers, "fd00::1", false},
+		{"IPv6 link-local", nil, DefaultDeniedPeers, "fe80::1", false},
+		{"allowed overrides denied", []string{"10.1.0.0/16"}, DefaultDeniedPeers, "10.1.2.3", true},
+		{"outside the allowed range", []string{"10.1.0.0/16"}, DefaultDeniedPeers, "10.2.0.1", false},
+		{"allowed single address", []string{"192.168.1.10"}, DefaultDeniedPeers, "192.168.1.10", true},
+		{"nothing denied", nil, nil, "10.1.2.3", true},
+	}
+	client := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 40000}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allowed, err := util.ParseNetworks(test.allowed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			denied, err := util.ParseNetworks(test.denied)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter := &peerFilter{allowed: allowed, denied: denied}
+			if got := filter.permit(client, net.ParseIP(test.peer)); got != test.want {
+				t.Errorf("permit(%s) = %v, want %v", test.peer, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+package turn
+
+import (
+	"container/list"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const (
+	// recordedPerClient is how many signed requests are kept per client address.
+	recordedPerClient = 4
+	// recordedTTL is how long a recorded request stays useful; requests are
+	// authenticated right after they are read.
+	recordedTTL = 10 * time.Second
+	// recordedMaxClients caps the client addresses requests are kept for.
+	// UDP sources can be spoofed, so when it is reached the least recently
+	// seen address is forgotten.
+	recordedMaxClients = 4096
+	// stunHeaderSize is the size of the STUN header before the attributes.
+	stunHeaderSize = 20
+)
+
+type recordedMessage struct {
+	message *stun.Message
+	at      time.Time
+}
+
+// recordedClient holds the latest requests of one client address, kept in
+// messageRecorder.order.
+type recordedClient struct {
+	key      string
+	messages []recordedMessage
+}
+
+// messageRecorder keeps the latest signed STUN requests of every client.
+// pion asks the AuthHandler for a single key per request, so when several
+// passwords are possible (rotated shared secrets) HandleAuthenticate uses the
+// recorded request to find the one the client actually signed with.
+type messageRecorder struct {
+	mutex   sync.Mutex
+	clients map[string]*list.Element
+	// order lists the clients, most recently seen first.
+	order    *list.List
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newMessageRecorder() *messageRecorder {
+	return &messageRecorder{
+		clients: make(map[string]*list.Element),
+		order:   list.New(),
+		stop:    make(chan struct{}),
+	}
+}
+
+// run drops stale requests every recordedTTL until Close is called.
+func (r *messageRecorder) run() {
+	ticker := time.NewTicker(recordedTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			r.sweep(now)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *messageRecorder) Close() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
+
+// sweep drops the clients not seen within recordedTTL of |now|. They are at
+// the back of the order.
+func (r *messageRecorder) sweep(now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for back := r.order.Back(); back != nil; back = r.order.Back() {
+		client := back.Value.(*recordedClient)
+		if now.Sub(client.messages[len(client.messages)-1].at) <= recordedTTL {
+			return
+		}
+		r.removeLocked(back)
+	}
+}
+
+func (r *messageRecorder) removeLocked(element *list.Element) {
+	r.order.Remove(element)
+	delete(r.clients, element.Value.(*recordedClient).key)
+}
+
+// messagesLocked returns the requests recorded from |addr|.
+func (r *messageRecorder) messagesLocked(addr net.Addr) []recordedMessage {
+	if element, ok := r.clients[addr.String()]; ok {
+		return element.Value.(*recordedClient).messages
+	}
+	return nil
+}
+
+// isSignedRequest reports whether |raw|, a STUN message, is a request that
+// carries MESSAGE-INTEGRITY. It only reads the header and attribute
+// headers, so relayed data is never copied or decoded.
+func isSignedRequest(raw []byte) bool {
+	var messageType stun.MessageType
+	messageType.ReadValue(binary.BigEndian.Uint16(raw[0:2]))
+	if messageType.Class != stun.ClassRequest {
+		return false
+	}
+	end := stunHeaderSize + int(binary.BigEndian.Uint16(raw[2:4]))
+	if end > len(raw) {
+		return false
+	}
+	for offset := stunHeaderSize; offset+4 <= end; {
+		attribute := stun.AttrType(binary.BigEndian.Uint16(raw[offset : offset+2]))
+		if attribute == stun.AttrMessageIntegrity {
+			return true
+		}
+		length := int(binary.BigEndian.Uint16(raw[offset+2 : offset+4]))
+		offset += 4 + (length+3)/4*4
+	}
+	return false
+}
+
+func (r *messageRecorder) record(addr net.Addr, raw []byte) {
+	if addr == nil || !stun.IsMessage(raw) || !isSignedRequest(raw) {
+		return
+	}
+	message := &stun.Message{Raw: append([]byte{}, raw...)}
+	if err := message.Decode(); err != nil || !message.Contains(stun.AttrMessageIntegrity) {
+		return
+	}
+	now := time.Now()
+	key := addr.String()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	element, ok := r.clients[key]
+	if ok {
+		r.order.MoveToFront(element)
+	} else {
+		if r.order.Len() >= recordedMaxClients {
+			r.removeLocked(r.order.Back())
+		}
+		element = r.order.PushFront(&recordedClient{key: key})
+		r.clients[key] = element
+	}
+	client := element.Value.(*recordedClient)
+	client.messages = append(client.messages, recordedMessage{message: message, at: now})
+	if len(client.messages) > recordedPerClient {
+		client.messages = client.messages[len(client.messages)-recordedPerClient:]
+	}
+}
+
+// match returns the password among |passwords| that signed the latest
+// request of |username| from |addr|.
+func (r *messageRecorder) match(addr net.Addr, username string, realm string, passwords []string) (string, bool) {
+	r.mutex.Lock()
+	recorded := r.messagesLocked(addr)
+	r.mutex.Unlock()
+
+	for i := len(recorded) - 1; i >= 0; i-- {
+		message := recorded[i].message
+		var user stun.Username
+		if err := user.GetFrom(message); err != nil || user.String() != username {
+			continue
+		}
+		for _, password := range passwords {
+			if stun.NewLongTermIntegrity(username, realm, password).Check(message) == nil {
+				return password, true
+			}
+		}
+	}
+	return "", false
+}
+
+// request returns the recorded request from |addr| with |transactionID|.
+func (r *messageRecorder) request(addr net.Addr, transactionID [stun.TransactionIDSize]byte) (*stun.Message, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, recorded := range r.messagesLocked(addr) {
+		if recorded.message.TransactionID == transactionID {
+			return recorded.message, true
+		}
+	}
+	return nil, false
+}
+
+// lastRequest returns the latest recorded request of |username| from |addr|.
+func (r *messageRecorder) lastRequest(addr net.Addr, username string) (*stun.Message, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	recorded := r.messagesLocked(addr)
+	for i := len(recorded) - 1; i >= 0; i-- {
+		var user stun.Username
+		if err := user.GetFrom(recorded[i].message); err == nil && user.String() == username {
+			return recorded[i].message, true
+		}
+	}
+	return nil, false
+}
+
+// recordingPacketConn records the requests read from a UDP listener and
+// watches the responses written to it.
+type recordingPacketConn struct {
+	net.PacketConn
+	server *TurnServer
+}
+
+func (c *recordingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.server.recorder.record(addr, p[:n])
+	}
+	return n, addr, err
+}
+
+func (c *recordingPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.server.observeResponse(addr, p)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// recordingListener records the requests read from TCP connections.
+type recordingListener struct {
+	net.Listener
+	server *TurnServer
+}
+
+func (l *recordingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &recordingConn{Conn: conn, server: l.server}, nil
+}
+
+// recordingConn splits the TCP byte stream into STUN and ChannelData frames
+// (RFC 5766 section 11.5) to record the STUN ones. pion writes one frame
+// per Write, so responses need no reassembly.
+type recordingConn struct {
+	net.Conn
+	server *TurnServer
+	buff   []byte
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.buff = append(c.buff, p[:n]...)
+		c.scan()
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.server.observeResponse(c.Conn.RemoteAddr(), p)
+	return c.Conn.Write(p)
+}
+
+func (c *recordingConn) scan() {
+	for len(c.buff) >= 4 {
+		length := int(binary.BigEndian.Uint16(c.buff[2:4]))
+		var size int
+		switch c.buff[0] >> 6 {
+		case 0: // STUN
+			size = 20 + length
+		case 1: // ChannelData, padded to 4 bytes over TCP
+			size = 4 + (length+3)/4*4
+		default:
+			// Not a TURN stream, stop looking at it.
+			c.buff = nil
+			return
+		}
+		if len(c.buff) < size {
+			return
+		}
+		if c.buff[0]>>6 == 0 {
+			c.server.recorder.record(c.Conn.RemoteAddr(), c.buff[:size])
+		}
+		c.buff = c.buff[size:]
+	}
+}
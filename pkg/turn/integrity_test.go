@@ -0,0 +1,249 @@
+package turn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/stun"
+)
+
+const testRealm = "flutter-webrtc"
+
+var testAddr = &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+
+// signedRequest builds an Allocate request of |username| signed with
+// |password|.
+func signedRequest(t *testing.T, username string, password string) []byte {
+	t.Helper()
+	message, err := stun.Build(
+		stun.TransactionID,
+		stun.NewType(stun.MethodAllocate, stun.ClassRequest),
+		stun.NewUsername(username),
+		stun.NewRealm(testRealm),
+		stun.NewNonce("nonce"),
+		stun.NewLongTermIntegrity(username, testRealm, password),
+		stun.Fingerprint,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message.Raw
+}
+
+func unsignedRequest(t *testing.T) []byte {
+	t.Helper()
+	message, err := stun.Build(stun.TransactionID, stun.BindingRequest, stun.Fingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message.Raw
+}
+
+// channelData builds a ChannelData frame with |length| bytes of payload,
+// padded to 4 bytes as over TCP.
+func channelData(length int) []byte {
+	frame := make([]byte, 4+(length+3)/4*4)
+	frame[0], frame[1] = 0x40, 0x00
+	frame[2], frame[3] = byte(length>>8), byte(length)
+	return frame
+}
+
+func concat(frames ...[]byte) []byte {
+	var stream []byte
+	for _, frame := range frames {
+		stream = append(stream, frame...)
+	}
+	return stream
+}
+
+// split cuts |stream| into reads of at most |size| bytes.
+func split(stream []byte, size int) [][]byte {
+	var reads [][]byte
+	for len(stream) > size {
+		reads = append(reads, stream[:size])
+		stream = stream[size:]
+	}
+	return append(reads, stream)
+}
+
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestRecordingConnScan(t *testing.T) {
+	signed := signedRequest(t, "1:alice", "secret")
+	tests := []struct {
+		name     string
+		reads    [][]byte
+		recorded int
+		buffered int
+	}{
+		{"one request", [][]byte{signed}, 1, 0},
+		{"request split across reads", split(signed, 7), 1, 0},
+		{"header split across reads", split(signed, 2), 1, 0},
+		{"two requests in one read", [][]byte{concat(signed, signed)}, 2, 0},
+		{"channel data then request", [][]byte{concat(channelData(5), signed)}, 1, 0},
+		{"request then channel data", split(concat(signed, channelData(13)), 9), 1, 0},
+		{"unsigned request", [][]byte{unsignedRequest(t)}, 0, 0},
+		{"partial request", [][]byte{signed[:len(signed)-1]}, 0, len(signed) - 1},
+		{"not a TURN stream", [][]byte{concat([]byte{0xff, 0xff, 0x00, 0x10}, signed)}, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &TurnServer{recorder: newMessageRecorder()}
+			conn := &recordingConn{Conn: addrConn{addr: testAddr}, server: server}
+			for _, read := range test.reads {
+				conn.buff = append(conn.buff, read...)
+				conn.scan()
+			}
+			if recorded := len(server.recorder.messagesLocked(testAddr)); recorded != test.recorded {
+				t.Errorf("recorded %d requests, want %d", recorded, test.recorded)
+			}
+			if len(conn.buff) != test.buffered {
+				t.Errorf("%d bytes left buffered, want %d", len(conn.buff), test.buffered)
+			}
+		})
+	}
+}
+
+func TestMessageRecorderMatch(t *testing.T) {
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 40000}
+	tests := []struct {
+		name      string
+		requests  [][]byte
+		addr      net.Addr
+		username  string
+		passwords []string
+		want      string
+		found     bool
+	}{
+		{
+			name:      "current secret",
+			requests:  [][]byte{signedRequest(t, "1:alice", "new")},
+			addr:      testAddr,
+			username:  "1:alice",
+			passwords: []string{"new", "old"},
+			want:      "new",
+			found:     true,
+		},
+		{
+			name:      "rotated secret",
+			requests:  [][]byte{signedRequest(t, "1:alice", "old")},
+			addr:      testAddr,
+			username:  "1:alice",
+			passwords: []string{"new", "old"},
+			want:      "old",
+			found:     true,
+		},
+		{
+			name:      "latest request wins",
+			requests:  [][]byte{signedRequest(t, "1:alice", "old"), signedRequest(t, "1:alice", "new")},
+			addr:      testAddr,
+			username:  "1:alice",
+			passwords: []string{"old", "new"},
+			want:      "new",
+			found:     true,
+		},
+		{
+			name:      "request of another user",
+			requests:  [][]byte{signedRequest(t, "1:bob", "new"), signedRequest(t, "1:alice", "old")},
+			addr:      testAddr,
+			username:  "1:alice",
+			passwords: []string{"new", "old"},
+			want:      "old",
+			found:     true,
+		},
+		{
+			name:      "unknown secret",
+			requests:  [][]byte{signedRequest(t, "1:alice", "stolen")},
+			addr:      testAddr,
+			username:  "1:alice",
+			passwords: []string{"new", "old"},
+		},
+		{
+			name:      "other client address",
+			requests:  [][]byte{signedRequest(t, "1:alice", "new")},
+			addr:      other,
+			username:  "1:alice",
+			passwords: []string{"new", "old"},
+		},
+		{
+			name:      "nothing recorded",
+			addr:      testAddr,
+			username:  "1:alice",
+			passwords: []string{"new", "old"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := newMessageRecorder()
+			for _, request := range test.requests {
+				recorder.record(testAddr, request)
+			}
+			password, found := recorder.match(test.addr, test.username, testRealm, test.passwords)
+			if password != test.want || found != test.found {
+				t.Errorf("match() = %q, %v, want %q, %v", password, found, test.want, test.found)
+			}
+		})
+	}
+}
+
+func TestMessageRecorderRecord(t *testing.T) {
+	indication, err := stun.Build(
+		stun.TransactionID,
+		stun.NewType(stun.MethodSend, stun.ClassIndication),
+		stun.NewUsername("1:alice"),
+		stun.NewLongTermIntegrity("1:alice", testRealm, "secret"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		raw      []byte
+		recorded int
+	}{
+		{"signed request", signedRequest(t, "1:alice", "secret"), 1},
+		{"unsigned request", unsignedRequest(t), 0},
+		{"indication", indication.Raw, 0},
+		{"truncated request", signedRequest(t, "1:alice", "secret")[:40], 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := newMessageRecorder()
+			recorder.record(testAddr, test.raw)
+			if recorded := len(recorder.messagesLocked(testAddr)); recorded != test.recorded {
+				t.Errorf("recorded %d requests, want %d", recorded, test.recorded)
+			}
+		})
+	}
+}
+
+func TestMessageRecorderBounds(t *testing.T) {
+	recorder := newMessageRecorder()
+	request := signedRequest(t, "1:alice", "secret")
+	for i := 0; i <= recordedMaxClients; i++ {
+		recorder.record(&net.UDPAddr{IP: net.IPv4(198, 51, byte(i>>8), byte(i)), Port: 40000}, request)
+	}
+	if recorder.order.Len() != recordedMaxClients || len(recorder.clients) != recordedMaxClients {
+		t.Fatalf("%d clients recorded, want %d", len(recorder.clients), recordedMaxClients)
+	}
+	if len(recorder.messagesLocked(&net.UDPAddr{IP: net.IPv4(198, 51, 0, 0), Port: 40000})) != 0 {
+		t.Errorf("least recently seen client kept")
+	}
+
+	recorder.sweep(time.Now())
+	if recorder.order.Len() != recordedMaxClients {
+		t.Errorf("%d clients left after sweeping fresh ones, want %d", recorder.order.Len(), recordedMaxClients)
+	}
+	recorder.sweep(time.Now().Add(recordedTTL + time.Second))
+	if recorder.order.Len() != 0 || len(recorder.clients) != 0 {
+		t.Errorf("%d clients left after sweeping stale ones, want none", len(recorder.clients))
+	}
+}
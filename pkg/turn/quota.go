@@ -0,0 +1,272 @@
+package turn
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/metrics"
+	"golang.org/x/time/rate"
+)
+
+// QuotaConfig limits what one user or one client IP may use. Zero values
+// mean unlimited. Users are the userid part of TURN REST usernames, so all
+// credentials minted for the same user share a quota.
+type QuotaConfig struct {
+	MaxAllocationsPerUser int
+	MaxAllocationsPerIP   int
+	// Relayed bytes per second, in both directions together.
+	MaxBandwidthPerUser int
+	MaxBandwidthPerIP   int
+}
+
+// allocation is what the server knows about one relay. The owner is learned
+// from the Allocate success response that carries the relay address.
+type allocation struct {
+	conn       io.Closer
+	relayAddr  net.Addr
+	username   string
+	clientAddr net.Addr
+	// permissions holds the peer IPs the client installed permissions for.
+	permissions map[string]bool
+
+	userLimiter *rate.Limiter
+	ipLimiter   *rate.Limiter
+	// throttled is set while packets are being dropped, accessed atomically.
+	throttled int32
+}
+
+// owner is a user or client IP with its allocation count and shared limiter.
+type owner struct {
+	allocations int
+	limiter     *rate.Limiter
+}
+
+// allocationTracker keeps relays, their owners and the per owner quotas.
+type allocationTracker struct {
+	config QuotaConfig
+
+	// notify reports allocation events, see TurnServer.EventHandler.
+	notify func(event AllocationEvent)
+
+	mutex    sync.RWMutex
+	byRelay  map[string]*allocation
+	byClient map[string]*allocation
+	users    map[string]*owner
+	ips      map[string]*owner
+}
+
+func newAllocationTracker(config QuotaConfig) *allocationTracker {
+	return &allocationTracker{
+		config:   config,
+		notify:   func(AllocationEvent) {},
+		byRelay:  make(map[string]*allocation),
+		byClient: make(map[string]*allocation),
+		users:    make(map[string]*owner),
+		ips:      make(map[string]*owner),
+	}
+}
+
+// UsernameUser returns the userid part of a TURN REST username
+// ("timestamp:userid"), which quotas are kept for.
+func UsernameUser(username string) string {
+	if i := strings.Index(username, ":"); i >= 0 {
+		return username[i+1:]
+	}
+	return username
+}
+
+func addrIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func newLimiter(bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	// Allow a second worth of burst, but at least a full datagram.
+	burst := bytesPerSecond
+	if burst < 65535 {
+		burst = 65535
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// add registers a new relay whose owner is not known yet.
+func (t *allocationTracker) add(relayAddr net.Addr, conn io.Closer) *allocation {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	a := &allocation{conn: conn, relayAddr: relayAddr, permissions: make(map[string]bool)}
+	t.byRelay[relayAddr.String()] = a
+	return a
+}
+
+// assign records the owner of the relay at |relayAddr|.
+func (t *allocationTracker) assign(relayAddr string, clientAddr net.Addr, username string) (*allocation, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	a, ok := t.byRelay[relayAddr]
+	if !ok || a.clientAddr != nil {
+		return nil, false
+	}
+	a.clientAddr = clientAddr
+	a.username = username
+	t.byClient[clientAddr.String()] = a
+	a.userLimiter = t.join(t.users, UsernameUser(username), t.config.MaxBandwidthPerUser)
+	a.ipLimiter = t.join(t.ips, addrIP(clientAddr), t.config.MaxBandwidthPerIP)
+	return a, true
+}
+
+func (t *allocationTracker) join(owners map[string]*owner, key string, bandwidth int) *rate.Limiter {
+	o, ok := owners[key]
+	if !ok {
+		o = &owner{limiter: newLimiter(bandwidth)}
+		owners[key] = o
+	}
+	o.allocations++
+	return o.limiter
+}
+
+func (t *allocationTracker) leave(owners map[string]*owner, key string) {
+	if o, ok := owners[key]; ok {
+		o.allocations--
+		if o.allocations <= 0 {
+			delete(owners, key)
+		}
+	}
+}
+
+// byClientAddr returns the allocation of the client at |clientAddr|.
+func (t *allocationTracker) byClientAddr(clientAddr net.Addr) (*allocation, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	a, ok := t.byClient[clientAddr.String()]
+	return a, ok
+}
+
+// permit records permissions of the client at |clientAddr| and returns the
+// peers that had none yet.
+func (t *allocationTracker) permit(clientAddr net.Addr, peers []net.Addr) (*allocation, []net.Addr) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	a, ok := t.byClient[clientAddr.String()]
+	if !ok {
+		return nil, nil
+	}
+	var added []net.Addr
+	for _, peer := range peers {
+		ip := addrIP(peer)
+		if !a.permissions[ip] {
+			a.permissions[ip] = true
+			added = append(added, peer)
+		}
+	}
+	return a, added
+}
+
+// ofUser returns the relay sockets of the allocations owned by |user|.
+func (t *allocationTracker) ofUser(user string) []io.Closer {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	var conns []io.Closer
+	for _, a := range t.byRelay {
+		if a.clientAddr != nil && UsernameUser(a.username) == user {
+			conns = append(conns, a.conn)
+		}
+	}
+	return conns
+}
+
+// remove forgets the relay |a| once its socket is closed.
+func (t *allocationTracker) remove(a *allocation) {
+	t.mutex.Lock()
+	key := a.relayAddr.String()
+	if _, ok := t.byRelay[key]; !ok {
+		t.mutex.Unlock()
+		return
+	}
+	delete(t.byRelay, key)
+	owned := a.clientAddr != nil
+	if owned {
+		if t.byClient[a.clientAddr.String()] == a {
+			delete(t.byClient, a.clientAddr.String())
+		}
+		t.leave(t.users, UsernameUser(a.username))
+		t.leave(t.ips, addrIP(a.clientAddr))
+	}
+	t.mutex.Unlock()
+
+	if owned {
+		t.notify(AllocationEvent{
+			Type:       AllocationDeleted,
+			Username:   a.username,
+			ClientAddr: a.clientAddr,
+			RelayAddr:  a.relayAddr,
+		})
+	}
+}
+
+// admit reports whether |username| at |clientAddr| may create another
+// allocation.
+func (t *allocationTracker) admit(username string, clientAddr net.Addr) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	user := UsernameUser(username)
+	if max := t.config.MaxAllocationsPerUser; max > 0 && t.count(t.users, user) >= max {
+		logger.Warnf("TURN quota: user %s reached %d allocations", user, max)
+		metrics.TurnQuotaExceeded.WithLabelValues("allocations_per_user").Inc()
+		return false
+	}
+	ip := addrIP(clientAddr)
+	if max := t.config.MaxAllocationsPerIP; max > 0 && t.count(t.ips, ip) >= max {
+		logger.Warnf("TURN quota: client %s reached %d allocations", ip, max)
+		metrics.TurnQuotaExceeded.WithLabelValues("allocations_per_ip").Inc()
+		return false
+	}
+	return true
+}
+
+func (t *allocationTracker) count(owners map[string]*owner, key string) int {
+	if o, ok := owners[key]; ok {
+		return o.allocations
+	}
+	return 0
+}
+
+// allowTraffic charges |n| relayed bytes to the owners of |a| and reports
+// whether the packet fits in their bandwidth.
+func (t *allocationTracker) allowTraffic(a *allocation, n int) bool {
+	if t.config.MaxBandwidthPerUser <= 0 && t.config.MaxBandwidthPerIP <= 0 {
+		return true
+	}
+	t.mutex.RLock()
+	userLimiter, ipLimiter := a.userLimiter, a.ipLimiter
+	t.mutex.RUnlock()
+
+	now := time.Now()
+	limit := ""
+	if userLimiter != nil && !userLimiter.AllowN(now, n) {
+		limit = "bandwidth_per_user"
+	} else if ipLimiter != nil && !ipLimiter.AllowN(now, n) {
+		limit = "bandwidth_per_ip"
+	}
+
+	if limit == "" {
+		atomic.StoreInt32(&a.throttled, 0)
+		return true
+	}
+	metrics.TurnQuotaExceeded.WithLabelValues(limit).Inc()
+	if atomic.CompareAndSwapInt32(&a.throttled, 0, 1) {
+		// Log once per burst of dropped packets
+		logger.Warnf("TURN quota: %s exceeded by %s from %v, dropping relayed packets", limit, a.username, a.clientAddr)
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package turn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/metrics"
+	"github.com/pion/turn/v2"
+)
+
+// relayAddressGenerator wraps the generator pion uses for allocations so the
+// server can see relays being created and, through relayPacketConn, closed.
+// pion always asks for "udp4" relays; network replaces that with the family
+// of the listener the generator belongs to.
+type relayAddressGenerator struct {
+	turn.RelayAddressGenerator
+	network string
+	tracker *allocationTracker
+}
+
+func (g *relayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	if len(g.network) > 0 {
+		network = g.network
+	}
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	metrics.TurnAllocations.Inc()
+	relay := &relayPacketConn{PacketConn: conn, tracker: g.tracker}
+	relay.allocation = g.tracker.add(addr, relay)
+	return relay, addr, nil
+}
+
+// relayPacketConn is the relay socket of one allocation; pion closes it when
+// the allocation is deleted or expires. Packets over the bandwidth quota of
+// the allocation owner are dropped.
+type relayPacketConn struct {
+	net.PacketConn
+	tracker    *allocationTracker
+	allocation *allocation
+	closeOnce  sync.Once
+}
+
+func (c *relayPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.tracker.allowTraffic(c.allocation, len(p)) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func (c *relayPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.tracker.allowTraffic(c.allocation, n) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *relayPacketConn) Close() error {
+	err := c.PacketConn.Close()
+	c.closeOnce.Do(func() {
+		metrics.TurnAllocations.Dec()
+		c.tracker.remove(c.allocation)
+	})
+	return err
+}
+
+// staticRelayAddressGenerator allocates relays on an ephemeral port of
+// Address. It replaces pion's RelayAddressGeneratorStatic, which joins host
+// and port with a plain colon and so cannot listen on an IPv6 address.
+type staticRelayAddressGenerator struct {
+	RelayAddress net.IP
+	Address      string
+}
+
+func (g *staticRelayAddressGenerator) Validate() error {
+	if g.RelayAddress == nil || g.Address == "" {
+		return errors.New("relay address is required")
+	}
+	return nil
+}
+
+func (g *staticRelayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, err := net.ListenPacket(network, net.JoinHostPort(g.Address, strconv.Itoa(requestedPort)))
+	if err != nil {
+		return nil, nil, err
+	}
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		conn.Close()
+		return nil, nil, fmt.Errorf("unexpected relay address %v", conn.LocalAddr())
+	}
+	return conn, &net.UDPAddr{IP: g.RelayAddress, Port: local.Port}, nil
+}
+
+func (g *staticRelayAddressGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, errors.New("TCP relays are not supported")
+}
+
+// portRangeRelayAddressGenerator allocates relays on the ports between
+// MinPort and MaxPort, walking the range so that an exhausted range is
+// reported right away instead of after random retries.
+type portRangeRelayAddressGenerator struct {
+	RelayAddress net.IP
+	Address      string
+	MinPort      int
+	MaxPort      int
+
+	mutex sync.Mutex
+	inUse map[int]bool
+	next  int
+}
+
+func (g *portRangeRelayAddressGenerator) Validate() error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.MinPort < 1 || g.MaxPort > 65535 || g.MinPort > g.MaxPort {
+		return fmt.Errorf("invalid relay port range %d-%d", g.MinPort, g.MaxPort)
+	}
+	if g.RelayAddress == nil || g.Address == "" {
+		return errors.New("relay address is required")
+	}
+	if g.inUse == nil {
+		g.inUse = make(map[int]bool)
+		g.next = g.MinPort
+	}
+	return nil
+}
+
+func (g *portRangeRelayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if requestedPort != 0 {
+		if requestedPort < g.MinPort || requestedPort > g.MaxPort || g.inUse[requestedPort] {
+			return nil, nil, fmt.Errorf("relay port %d not available", requestedPort)
+		}
+		return g.listenLocked(network, requestedPort)
+	}
+	for i := g.MinPort; i <= g.MaxPort; i++ {
+		port := g.next
+		g.next++
+		if g.next > g.MaxPort {
+			g.next = g.MinPort
+		}
+		if g.inUse[port] {
+			continue
+		}
+		if conn, addr, err := g.listenLocked(network, port); err == nil {
+			return conn, addr, nil
+		}
+	}
+	logger.Errorf("TURN relay port range %d-%d on %s exhausted", g.MinPort, g.MaxPort, g.Address)
+	return nil, nil, fmt.Errorf("relay port range %d-%d exhausted", g.MinPort, g.MaxPort)
+}
+
+func (g *portRangeRelayAddressGenerator) listenLocked(network string, port int) (net.PacketConn, net.Addr, error) {
+	conn, err := net.ListenPacket(network, net.JoinHostPort(g.Address, strconv.Itoa(port)))
+	if err != nil {
+		return nil, nil, err
+	}
+	g.inUse[port] = true
+	relayAddr := &net.UDPAddr{IP: g.RelayAddress, Port: port}
+	return &rangePacketConn{PacketConn: conn, release: func() {
+		g.mutex.Lock()
+		delete(g.inUse, port)
+		g.mutex.Unlock()
+	}}, relayAddr, nil
+}
+
+func (g *portRangeRelayAddressGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, errors.New("TCP relays are not supported")
+}
+
+// rangePacketConn gives its port back to the range when closed.
+type rangePacketConn struct {
+	net.PacketConn
+	closeOnce sync.Once
+	release   func()
+}
+
+func (c *rangePacketConn) Close() error {
+	err := c.PacketConn.Close()
+	c.closeOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,50 @@
+package turn
+
+import (
+	"net"
+	"testing"
+
+	"github.com/pion/turn/v2"
+)
+
+func TestRelayAddressGeneratorUDP6(t *testing.T) {
+	probe, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	probe.Close()
+
+	relayIP := net.ParseIP("2001:db8::1")
+	tests := []struct {
+		name      string
+		generator turn.RelayAddressGenerator
+	}{
+		{"any address", &staticRelayAddressGenerator{RelayAddress: relayIP, Address: "::"}},
+		{"address literal", &staticRelayAddressGenerator{RelayAddress: relayIP, Address: "::1"}},
+		{"port range", &portRangeRelayAddressGenerator{RelayAddress: relayIP, Address: "::1", MinPort: 40000, MaxPort: 40100}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.generator.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			generator := &relayAddressGenerator{
+				network:               "udp6",
+				RelayAddressGenerator: test.generator,
+				tracker:               newAllocationTracker(QuotaConfig{}),
+			}
+			conn, addr, err := generator.AllocatePacketConn("udp4", 0)
+			if err != nil {
+				t.Fatalf("allocating a udp6 relay: %v", err)
+			}
+			defer conn.Close()
+			relayAddr, ok := addr.(*net.UDPAddr)
+			if !ok || !relayAddr.IP.Equal(relayIP) || relayAddr.Port == 0 {
+				t.Errorf("relay address %v, want %s with a port", addr, relayIP)
+			}
+			if local := conn.LocalAddr().(*net.UDPAddr); local.IP.To4() != nil || local.Port != relayAddr.Port {
+				t.Errorf("relay listens on %v, want an IPv6 socket on port %d", local, relayAddr.Port)
+			}
+		})
+	}
+}
@@ -1,26 +1,49 @@
 package turn
 
 import (
+	"crypto/tls"
 	"net"
 	"strconv"
 
 	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/util"
+	"github.com/pion/dtls/v2"
+	"github.com/pion/stun"
 	"github.com/pion/turn/v2"
 )
 
 type TurnServerConfig struct {
 	PublicIP string
-	Port     int
-	PortTCP  int
+	// PublicIPv6 enables the IPv6 listeners and relays when set.
+	PublicIPv6 string
+	Port       int
+	PortTCP    int
+	// PortTLS and PortDTLS enable the turns: listeners when non-zero.
+	PortTLS  int
+	PortDTLS int
+	CertFile string
+	KeyFile  string
 	Realm    string
+	// RelayMinPort and RelayMaxPort restrict relays to a port range when set.
+	RelayMinPort int
+	RelayMaxPort int
+	// RelayAddress and RelayAddressV6 are the local addresses relays bind to.
+	RelayAddress   string
+	RelayAddressV6 string
+	// DeniedPeers are the networks relays may not send to, AllowedPeers
+	// the exceptions, as CIDRs or addresses.
+	DeniedPeers  []string
+	AllowedPeers []string
+	Quota        QuotaConfig
 }
 
 func DefaultConfig() TurnServerConfig {
 	return TurnServerConfig{
-		PublicIP: "127.0.0.1",
-		Port:     19302,
-		PortTCP:  19303,
-		Realm:    "flutter-webrtc",
+		PublicIP:    "127.0.0.1",
+		Port:        19302,
+		PortTCP:     19303,
+		Realm:       "flutter-webrtc",
+		DeniedPeers: DefaultDeniedPeers,
 	}
 }
 
@@ -32,14 +55,31 @@ if key, ok := usersMap[username]; ok {
 */
 
 type TurnServer struct {
-	udpListener net.PacketConn
-	tcpListener net.Listener
+	packetConns []net.PacketConn
+	listeners   []net.Listener
 	turnServer  *turn.Server
-	Config      TurnServerConfig
-	AuthHandler func(username string, realm string, srcAddr net.Addr) (string, bool)
+	recorder    *messageRecorder
+	tracker     *allocationTracker
+	// certificates of the TLS and DTLS listeners, reloaded on change.
+	certificates *util.CertReloader
+	Config       TurnServerConfig
+	// AuthHandler returns the passwords |username| may have used. With more
+	// than one (rotated secrets) the one that signed the request is picked.
+	AuthHandler func(username string, realm string, srcAddr net.Addr) ([]string, bool)
+	// EventHandler is told about allocations and permissions as the server
+	// grants them. It runs on the packet path and must not block.
+	EventHandler func(event AllocationEvent)
 }
 
-func resolvePublicIP(publicIP string) net.IP {
+// family is one IP version the server listens and relays on.
+type family struct {
+	name      string // "4" or "6", appended to the network names
+	bind      string
+	relayBind string
+	relayIP   net.IP
+}
+
+func resolvePublicIP(publicIP string, ipv6 bool) net.IP {
 	ip := net.ParseIP(publicIP)
 	if ip != nil {
 		return ip
@@ -49,9 +89,9 @@ func resolvePublicIP(publicIP string) net.IP {
 	if err != nil || len(ips) == 0 {
 		logger.Panicf("Cannot resolve public_ip '%s': %v", publicIP, err)
 	}
-	// Prefer IPv4
+	// Prefer the requested family
 	for _, resolved := range ips {
-		if resolved.To4() != nil {
+		if (resolved.To4() == nil) == ipv6 {
 			logger.Infof("Resolved public_ip '%s' to %s", publicIP, resolved.String())
 			return resolved
 		}
@@ -64,70 +104,218 @@ func NewTurnServer(config TurnServerConfig) *TurnServer {
 	server := &TurnServer{
 		Config:      config,
 		AuthHandler: nil,
+		recorder:    newMessageRecorder(),
+		tracker:     newAllocationTracker(config.Quota),
 	}
+	server.tracker.notify = server.notify
 	if len(config.PublicIP) == 0 {
 		logger.Panicf("'public-ip' is required")
 	}
 
-	relayIP := resolvePublicIP(config.PublicIP)
+	families := []family{
+		{name: "4", bind: "0.0.0.0", relayBind: config.RelayAddress, relayIP: resolvePublicIP(config.PublicIP, false)},
+	}
+	if len(config.PublicIPv6) > 0 {
+		relayIP := resolvePublicIP(config.PublicIPv6, true)
+		if relayIP.To4() != nil {
+			logger.Panicf("'public_ip_v6' %s is not an IPv6 address", config.PublicIPv6)
+		}
+		families = append(families, family{name: "6", bind: "::", relayBind: config.RelayAddressV6, relayIP: relayIP})
+	}
+	if config.RelayMinPort != 0 || config.RelayMaxPort != 0 {
+		if config.RelayMinPort < 1 || config.RelayMaxPort > 65535 || config.RelayMinPort > config.RelayMaxPort {
+			logger.Panicf("Invalid TURN relay port range %d-%d", config.RelayMinPort, config.RelayMaxPort)
+		}
+		logger.Infof("TURN relays use ports %d-%d", config.RelayMinPort, config.RelayMaxPort)
+	}
 
-	// Create UDP listener
-	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:"+strconv.Itoa(config.Port))
-	if err != nil {
-		logger.Panicf("Failed to create TURN server UDP listener: %s", err)
+	filter := &peerFilter{}
+	var err error
+	if filter.denied, err = util.ParseNetworks(config.DeniedPeers); err != nil {
+		logger.Panicf("Invalid TURN denied peer network: %v", err)
+	}
+	if filter.allowed, err = util.ParseNetworks(config.AllowedPeers); err != nil {
+		logger.Panicf("Invalid TURN allowed peer network: %v", err)
 	}
-	server.udpListener = udpListener
-	logger.Infof("TURN server UDP listener started on port %d", config.Port)
 
-	// Create TCP listener
-	tcpListener, err := net.Listen("tcp4", "0.0.0.0:"+strconv.Itoa(config.PortTCP))
-	if err != nil {
-		udpListener.Close() // Clean up UDP listener on failure
-		logger.Panicf("Failed to create TURN server TCP listener: %s", err)
+	if config.PortTLS > 0 || config.PortDTLS > 0 {
+		server.certificates, err = util.NewCertReloader(config.CertFile, config.KeyFile)
+		if err != nil {
+			logger.Panicf("Failed to load TURN server certificate: %s", err)
+		}
 	}
-	server.tcpListener = tcpListener
-	logger.Infof("TURN server TCP listener started on port %d", config.PortTCP)
 
-	turnServer, err := turn.NewServer(turn.ServerConfig{
-		Realm:       config.Realm,
-		AuthHandler: server.HandleAuthenticate,
-		PacketConnConfigs: []turn.PacketConnConfig{
-			{
-				PacketConn: udpListener,
-				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
-					RelayAddress: relayIP,
-					Address:      "0.0.0.0",
-				},
-			},
-		},
-		ListenerConfigs: []turn.ListenerConfig{
-			{
-				Listener: tcpListener,
-				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
-					RelayAddress: relayIP,
-					Address:      "0.0.0.0",
+	var packetConnConfigs []turn.PacketConnConfig
+	var listenerConfigs []turn.ListenerConfig
+	for _, f := range families {
+		relayBind := f.relayBind
+		if len(relayBind) == 0 {
+			relayBind = f.bind
+		}
+		var relayGenerator turn.RelayAddressGenerator = &staticRelayAddressGenerator{
+			RelayAddress: f.relayIP,
+			Address:      relayBind,
+		}
+		if config.RelayMinPort != 0 {
+			// One range per family, shared by all its listeners
+			relayGenerator = &portRangeRelayAddressGenerator{
+				RelayAddress: f.relayIP,
+				Address:      relayBind,
+				MinPort:      config.RelayMinPort,
+				MaxPort:      config.RelayMaxPort,
+			}
+		}
+		// Clients reach the server over one family and are relayed on the
+		// same one, so every listener gets a generator for its own family.
+		newRelayAddressGenerator := func() turn.RelayAddressGenerator {
+			return &relayAddressGenerator{
+				network:               "udp" + f.name,
+				RelayAddressGenerator: relayGenerator,
+				tracker:               server.tracker,
+			}
+		}
+		address := func(port int) string {
+			return net.JoinHostPort(f.bind, strconv.Itoa(port))
+		}
+
+		// Create UDP listener
+		udpListener, err := net.ListenPacket("udp"+f.name, address(config.Port))
+		if err != nil {
+			server.closeListeners()
+			logger.Panicf("Failed to create TURN server UDP listener: %s", err)
+		}
+		server.packetConns = append(server.packetConns, udpListener)
+		packetConnConfigs = append(packetConnConfigs, turn.PacketConnConfig{
+			PacketConn:            &recordingPacketConn{PacketConn: udpListener, server: server},
+			RelayAddressGenerator: newRelayAddressGenerator(),
+			PermissionHandler:     filter.permit,
+		})
+		logger.Infof("TURN server UDP listener started on %s", address(config.Port))
+
+		// Create TCP listener
+		tcpListener, err := net.Listen("tcp"+f.name, address(config.PortTCP))
+		if err != nil {
+			server.closeListeners() // Clean up listeners on failure
+			logger.Panicf("Failed to create TURN server TCP listener: %s", err)
+		}
+		server.listeners = append(server.listeners, tcpListener)
+		listenerConfigs = append(listenerConfigs, turn.ListenerConfig{
+			Listener:              &recordingListener{Listener: tcpListener, server: server},
+			RelayAddressGenerator: newRelayAddressGenerator(),
+			PermissionHandler:     filter.permit,
+		})
+		logger.Infof("TURN server TCP listener started on %s", address(config.PortTCP))
+
+		// Create TLS listener
+		if config.PortTLS > 0 {
+			tlsListener, err := tls.Listen("tcp"+f.name, address(config.PortTLS), &tls.Config{
+				GetCertificate: server.certificates.GetCertificate,
+			})
+			if err != nil {
+				server.closeListeners()
+				logger.Panicf("Failed to create TURN server TLS listener: %s", err)
+			}
+			server.listeners = append(server.listeners, tlsListener)
+			listenerConfigs = append(listenerConfigs, turn.ListenerConfig{
+				Listener:              &recordingListener{Listener: tlsListener, server: server},
+				RelayAddressGenerator: newRelayAddressGenerator(),
+				PermissionHandler:     filter.permit,
+			})
+			logger.Infof("TURN server TLS listener started on %s", address(config.PortTLS))
+		}
+
+		// Create DTLS listener
+		if config.PortDTLS > 0 {
+			dtlsListener, err := listenDTLS("udp"+f.name, &net.UDPAddr{IP: net.ParseIP(f.bind), Port: config.PortDTLS}, &dtls.Config{
+				GetCertificate: func(*dtls.ClientHelloInfo) (*tls.Certificate, error) {
+					return server.certificates.Certificate(), nil
 				},
-			},
-		},
+				ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+			})
+			if err != nil {
+				server.closeListeners()
+				logger.Panicf("Failed to create TURN server DTLS listener: %s", err)
+			}
+			server.listeners = append(server.listeners, dtlsListener)
+			listenerConfigs = append(listenerConfigs, turn.ListenerConfig{
+				Listener:              &recordingListener{Listener: dtlsListener, server: server},
+				RelayAddressGenerator: newRelayAddressGenerator(),
+				PermissionHandler:     filter.permit,
+			})
+			logger.Infof("TURN server DTLS listener started on %s", address(config.PortDTLS))
+		}
+	}
+
+	turnServer, err := turn.NewServer(turn.ServerConfig{
+		Realm:             config.Realm,
+		AuthHandler:       server.HandleAuthenticate,
+		PacketConnConfigs: packetConnConfigs,
+		ListenerConfigs:   listenerConfigs,
 	})
 	if err != nil {
-		udpListener.Close() // Clean up listeners on failure
-		tcpListener.Close()
+		server.closeListeners() // Clean up listeners on failure
 		logger.Panicf("%v", err)
 	}
 	server.turnServer = turnServer
+	go server.recorder.run()
 	return server
 }
 
+// closeListeners releases the listeners opened so far when setup fails.
+func (s *TurnServer) closeListeners() {
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	for _, conn := range s.packetConns {
+		conn.Close()
+	}
+}
+
+// HandleAuthenticate returns the key of |username| for pion. Allocations
+// over quota are refused before AuthHandler runs, so they are logged and
+// counted as quota refusals rather than as authentication results. pion has
+// no way to tell the two apart on the wire: the client gets 400 Bad Request
+// for both.
 func (s *TurnServer) HandleAuthenticate(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
-	if s.AuthHandler != nil {
-		if password, ok := s.AuthHandler(username, realm, srcAddr); ok {
-			return turn.GenerateAuthKey(username, realm, password), true
+	if s.AuthHandler == nil {
+		return nil, false
+	}
+	if request, found := s.recorder.lastRequest(srcAddr, username); found && request.Type.Method == stun.MethodAllocate {
+		if !s.tracker.admit(username, srcAddr) {
+			return nil, false
+		}
+	}
+	passwords, ok := s.AuthHandler(username, realm, srcAddr)
+	if !ok || len(passwords) == 0 {
+		return nil, false
+	}
+	password := passwords[0]
+	if len(passwords) > 1 {
+		if matched, found := s.recorder.match(srcAddr, username, realm, passwords); found {
+			password = matched
 		}
 	}
-	return nil, false
+	return turn.GenerateAuthKey(username, realm, password), true
 }
 
 func (s *TurnServer) Close() error {
+	s.recorder.Close()
+	if s.certificates != nil {
+		s.certificates.Close()
+	}
 	return s.turnServer.Close()
 }
+
+// CloseAllocations closes the relays of every allocation of |user|, the
+// userid part of its TURN REST usernames, and returns how many there were.
+// pion deletes an allocation as soon as its relay socket fails.
+func (s *TurnServer) CloseAllocations(user string) int {
+	conns := s.tracker.ofUser(user)
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if len(conns) > 0 {
+		logger.Warnf("TURN: closed %d allocations of user %s", len(conns), user)
+	}
+	return len(conns)
+}
@@ -0,0 +1,121 @@
+package util
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// CertReloader serves a certificate and key pair read from disk and reloads
+// it when either file changes, so renewed certificates apply without a
+// restart. A pair that fails to load keeps the previous one in use.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	lck         sync.RWMutex
+	certificate *tls.Certificate
+	modTime     time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stop:     make(chan struct{}),
+	}
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+// filesModTime is the latest modification time of the two files.
+func (r *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *CertReloader) load(modTime time.Time) error {
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.lck.Lock()
+	r.certificate = &certificate
+	r.modTime = modTime
+	r.lck.Unlock()
+	return nil
+}
+
+func (r *CertReloader) watch() {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			modTime, err := r.filesModTime()
+			if err != nil {
+				logger.Warnf("Certificate %s: %v", r.certFile, err)
+				continue
+			}
+			r.lck.RLock()
+			changed := !modTime.Equal(r.modTime)
+			r.lck.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := r.load(modTime); err != nil {
+				// Possibly half written, retried on the next tick
+				logger.Warnf("Failed to reload certificate %s: %v", r.certFile, err)
+				continue
+			}
+			logger.Infof("Reloaded certificate %s", r.certFile)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Certificate returns the current certificate.
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.lck.RLock()
+	defer r.lck.RUnlock()
+	return r.certificate
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// Close stops watching the files.
+func (r *CertReloader) Close() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
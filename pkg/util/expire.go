@@ -20,6 +20,7 @@ type ExpiredMap struct {
 	timeMap  map[int64][]interface{}
 	lck      *sync.Mutex
 	stop     chan struct{}
+	stopOnce sync.Once
 	needStop int32
 }
 
@@ -56,7 +57,10 @@ func (e *ExpiredMap) run(now int64) {
 		select {
 		case <-t.C:
 			now++
-			if keys, found := e.timeMap[now]; found {
+			e.lck.Lock()
+			keys, found := e.timeMap[now]
+			e.lck.Unlock()
+			if found {
 				delCh <- &delMsg{keys: keys, t: now}
 			}
 		case <-e.stop:
@@ -72,7 +76,8 @@ func (e *ExpiredMap) Set(key, value interface{}, expireSeconds int64) {
 	if expireSeconds <= 0 {
 		return
 	}
-	logger.Debugf("ExpiredMap: Set %s ttl[%d] => %v", key, expireSeconds, value)
+	// The value is not logged, it may be a TURN password.
+	logger.Debugf("ExpiredMap: Set %s ttl[%d]", key, expireSeconds)
 	e.lck.Lock()
 	defer e.lck.Unlock()
 	expiredTime := time.Now().Unix() + expireSeconds
@@ -108,6 +113,10 @@ func (e *ExpiredMap) multiDelete(keys []interface{}, t int64) {
 	defer e.lck.Unlock()
 	delete(e.timeMap, t)
 	for _, key := range keys {
+		// Skip keys Set again since with a later expiry.
+		if v, found := e.m[key]; found && v.expiredTime > t {
+			continue
+		}
 		delete(e.m, key)
 	}
 }
@@ -139,9 +148,9 @@ func (e *ExpiredMap) Clear() {
 }
 
 func (e *ExpiredMap) Close() {
-	e.lck.Lock()
-	defer e.lck.Unlock()
-	e.stop <- struct{}{}
+	e.stopOnce.Do(func() {
+		close(e.stop)
+	})
 }
 
 func (e *ExpiredMap) Stop() {
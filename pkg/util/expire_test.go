@@ -0,0 +1,25 @@
+package util
+
+import "testing"
+
+func TestExpiredMapSetAgainAfterDelete(t *testing.T) {
+	e := NewExpiredMap()
+	defer e.Close()
+
+	e.Set("u", 1, 10)
+	first := e.m["u"].expiredTime
+	e.Delete("u")
+	e.Set("u", 2, 20)
+
+	// The tick of the first expiry still lists "u".
+	e.multiDelete(e.timeMap[first], first)
+	if found, value := e.Get("u"); !found || value != 2 {
+		t.Fatalf("Get(u) = %v, %v after the first expiry, want true, 2", found, value)
+	}
+
+	second := e.m["u"].expiredTime
+	e.multiDelete(e.timeMap[second], second)
+	if e.Length() != 0 {
+		t.Errorf("%d keys left after the second expiry, want none", e.Length())
+	}
+}
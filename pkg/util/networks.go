@@ -0,0 +1,79 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseNetworks parses CIDRs, or single addresses, into networks.
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ContainsIP reports whether |ip| is in one of |networks|.
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client that sent |request|. Connections from
+// |trustedProxies| are taken to be forwarded: X-Forwarded-For is read from
+// the right, skipping the trusted proxies, and the first other address is
+// the client. Anything else is the address of the connection itself.
+func ClientIP(request *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	if len(trustedProxies) == 0 {
+		return host
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ContainsIP(trustedProxies, ip) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(request.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			// Whatever came before this hop cannot be trusted
+			break
+		}
+		host = ip.String()
+		if !ContainsIP(trustedProxies, ip) {
+			break
+		}
+	}
+	return host
+}
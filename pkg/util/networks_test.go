@@ -0,0 +1,43 @@
+package util
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    []string
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{"no proxies", nil, "198.51.100.1:5000", []string{"203.0.113.7"}, "198.51.100.1"},
+		{"untrusted peer", []string{"10.0.0.0/8"}, "198.51.100.1:5000", []string{"203.0.113.7"}, "198.51.100.1"},
+		{"trusted proxy", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"trusted proxy without header", []string{"10.0.0.0/8"}, "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"spoofed entries are skipped", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"1.1.1.1, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of proxies", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"203.0.113.7, 10.0.0.9"}, "203.0.113.7"},
+		{"repeated headers", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"1.1.1.1", "203.0.113.7"}, "203.0.113.7"},
+		{"garbage stops the walk", []string{"10.0.0.0/8"}, "10.0.0.2:5000", []string{"203.0.113.7, garbage, 10.0.0.9"}, "10.0.0.9"},
+		{"IPv6", []string{"::1"}, "[::1]:5000", []string{"2001:db8::7"}, "2001:db8::7"},
+		{"no port", nil, "198.51.100.1", nil, "198.51.100.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			trusted, err := ParseNetworks(test.trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := httptest.NewRequest("GET", "/", nil)
+			request.RemoteAddr = test.remoteAddr
+			for _, value := range test.forwarded {
+				request.Header.Add("X-Forwarded-For", value)
+			}
+			if got := ClientIP(request, trusted); got != test.want {
+				t.Errorf("ClientIP() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterPruneSize is the number of keys that triggers dropping the
+// limiters that are full again.
+const rateLimiterPruneSize = 4096
+
+// RateLimiter is a token bucket per key, e.g. per client IP.
+type RateLimiter struct {
+	limit    rate.Limit
+	burst    int
+	lck      sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewRateLimiter allows |perMinute| events per key and minute, in bursts of
+// up to |perMinute|. A |perMinute| of 0 or less disables the limit.
+func NewRateLimiter(perMinute int) *RateLimiter {
+	if perMinute <= 0 {
+		return &RateLimiter{limit: rate.Inf}
+	}
+	return &RateLimiter{
+		limit:    rate.Limit(float64(perMinute) / 60),
+		burst:    perMinute,
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// Allow takes an event for |key| and reports whether it fits in the limit.
+// When it does not, the returned duration is the time until it would.
+func (r *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if r.limit == rate.Inf {
+		return true, 0
+	}
+	now := time.Now()
+
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	if len(r.limiters) >= rateLimiterPruneSize {
+		for k, limiter := range r.limiters {
+			if limiter.TokensAt(now) >= float64(r.burst) {
+				delete(r.limiters, k)
+			}
+		}
+	}
+	limiter, ok := r.limiters[key]
+	if !ok {
+		limiter = rate.NewLimiter(r.limit, r.burst)
+		r.limiters[key] = limiter
+	}
+	reservation := limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/util"
+)
+
+// originAllowed matches the Origin header of a handshake against
+// |allowed|. Entries are origins such as https://app.example.com, where the
+// scheme may be left out and a leading "*." matches any subdomain; "*"
+// matches everything. Entries without a port match any port. Clients that
+// send no Origin, like native apps, are always allowed, as is everyone when
+// |allowed| is empty.
+func originAllowed(allowed []string, origin string) bool {
+	if len(allowed) == 0 || len(origin) == 0 {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil || len(parsed.Host) == 0 {
+		return false
+	}
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*" {
+			return true
+		}
+		if i := strings.Index(pattern, "://"); i >= 0 {
+			if pattern[:i] != strings.ToLower(parsed.Scheme) {
+				continue
+			}
+			pattern = pattern[i+3:]
+		}
+		host := strings.ToLower(parsed.Host)
+		if strings.LastIndex(pattern, ":") <= strings.LastIndex(pattern, "]") {
+			host = strings.ToLower(parsed.Hostname())
+			pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]")
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// admission caps the concurrent WebSocket connections, in total and per
+// client IP, and the rate of handshakes per client IP.
+type admission struct {
+	maxConnections      int
+	maxConnectionsPerIP int
+	handshakes          *util.RateLimiter
+
+	mutex sync.Mutex
+	total int
+	perIP map[string]int
+}
+
+func newAdmission(cfg WebSocketServerConfig) *admission {
+	return &admission{
+		maxConnections:      cfg.MaxConnections,
+		maxConnectionsPerIP: cfg.MaxConnectionsPerIP,
+		handshakes:          util.NewRateLimiter(cfg.HandshakeRateLimit),
+		perIP:               make(map[string]int),
+	}
+}
+
+// admit answers the handshake with an error status and returns false when
+// the connection is over a limit. Admitted connections must be released.
+func (a *admission) admit(writer http.ResponseWriter, request *http.Request, origins []string) bool {
+	ip := util.ClientIP(request, nil)
+	if ok, retryAfter := a.handshakes.Allow(ip); !ok {
+		logger.Warnf("WebSocket handshake from %s rate limited", ip)
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		http.Error(writer, "Too many requests", http.StatusTooManyRequests)
+		return false
+	}
+	if origin := request.Header.Get("Origin"); !originAllowed(origins, origin) {
+		logger.Warnf("WebSocket handshake from %s with origin %s rejected", ip, origin)
+		http.Error(writer, "Origin not allowed", http.StatusForbidden)
+		return false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.maxConnections > 0 && a.total >= a.maxConnections {
+		logger.Warnf("WebSocket connection limit of %d reached, rejecting %s", a.maxConnections, ip)
+		http.Error(writer, "Too many connections", http.StatusServiceUnavailable)
+		return false
+	}
+	if a.maxConnectionsPerIP > 0 && a.perIP[ip] >= a.maxConnectionsPerIP {
+		logger.Warnf("WebSocket connection limit of %d per IP reached by %s", a.maxConnectionsPerIP, ip)
+		http.Error(writer, "Too many connections", http.StatusTooManyRequests)
+		return false
+	}
+	a.total++
+	a.perIP[ip]++
+	return true
+}
+
+func (a *admission) release(request *http.Request) {
+	ip := util.ClientIP(request, nil)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.total--
+	if a.perIP[ip]--; a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
@@ -0,0 +1,42 @@
+package websocket
+
+import "testing"
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{"no allowlist", nil, "https://evil.example", true},
+		{"no origin", []string{"https://app.example.com"}, "", true},
+		{"exact origin", []string{"https://app.example.com"}, "https://app.example.com", true},
+		{"other host", []string{"https://app.example.com"}, "https://evil.example", false},
+		{"other scheme", []string{"https://app.example.com"}, "http://app.example.com", false},
+		{"scheme left out", []string{"app.example.com"}, "http://app.example.com", true},
+		{"case and spaces", []string{" HTTPS://App.Example.com "}, "https://app.example.COM", true},
+		{"any origin", []string{"*"}, "https://evil.example", true},
+		{"subdomain wildcard", []string{"*.example.com"}, "https://a.b.example.com", true},
+		{"wildcard needs a subdomain", []string{"*.example.com"}, "https://example.com", false},
+		{"wildcard suffix only", []string{"*.example.com"}, "https://evilexample.com", false},
+		{"lookalike suffix", []string{"app.example.com"}, "https://app.example.com.evil.example", false},
+		{"any port", []string{"http://localhost"}, "http://localhost:3000", true},
+		{"wildcard any port", []string{"*.example.com"}, "https://a.example.com:8443", true},
+		{"same port", []string{"http://localhost:3000"}, "http://localhost:3000", true},
+		{"other port", []string{"http://localhost:3000"}, "http://localhost:3001", false},
+		{"port required", []string{"http://localhost:3000"}, "http://localhost", false},
+		{"IPv6 any port", []string{"[::1]"}, "http://[::1]:8080", true},
+		{"IPv6 with port", []string{"[::1]:8080"}, "http://[::1]:8080", true},
+		{"IPv6 other port", []string{"[::1]:8080"}, "http://[::1]:9090", false},
+		{"opaque origin", []string{"https://app.example.com"}, "null", false},
+		{"second entry", []string{"https://a.example", "https://b.example"}, "https://b.example", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := originAllowed(test.allowed, test.origin); got != test.want {
+				t.Errorf("originAllowed(%q, %q) = %v, want %v", test.allowed, test.origin, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// DeflateSubprotocol is the WebSocket subprotocol of clients that exchange
+// messages as raw DEFLATE (RFC 1951) compressed JSON in binary frames,
+// for client stacks without permessage-deflate. The server then replies in
+// binary frames encoded the same way.
+const DeflateSubprotocol = "signaling+deflate"
+
+var errMessageTooBig = errors.New("websocket: inflated message too big")
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return writer
+}}
+
+// deflate compresses |data| into a raw DEFLATE stream.
+func deflate(data []byte) []byte {
+	var buff bytes.Buffer
+	writer := flateWriters.Get().(*flate.Writer)
+	writer.Reset(&buff)
+	writer.Write(data)
+	writer.Close()
+	flateWriters.Put(writer)
+	return buff.Bytes()
+}
+
+// inflate decompresses the raw DEFLATE stream |data|, failing when it
+// inflates to more than |limit| bytes, unless |limit| is 0.
+func inflate(data []byte, limit int64) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	if limit <= 0 {
+		return ioutil.ReadAll(reader)
+	}
+	message, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(message)) > limit {
+		return nil, errMessageTooBig
+	}
+	return message, nil
+}
@@ -0,0 +1,85 @@
+package websocket
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoServer serves connections that send back every message and report
+// binary frames without a codec as "binary:<payload>".
+func echoServer(t *testing.T) string {
+	t.Helper()
+	config := DefaultConfig()
+	config.HTMLRoot = ""
+	server := NewWebSocketServer(config, func(conn *WebSocketConn, request *http.Request) {
+		conn.On("message", func(message []byte) {
+			conn.Send(string(message))
+		})
+		conn.On("binary", func(message []byte) {
+			conn.Send("binary:" + string(message))
+		})
+	}, nil, nil)
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+	return "ws" + strings.TrimPrefix(httpServer.URL, "http") + config.WebSocketPath
+}
+
+func TestDeflateSubprotocol(t *testing.T) {
+	message := []byte(`{"type":"offer","data":{"sdp":"` + strings.Repeat("a=candidate ", 100) + `"}}`)
+	tests := []struct {
+		name         string
+		subprotocols []string
+		frameType    int
+		frame        []byte
+		wantType     int
+		want         []byte
+	}{
+		{"text", nil, websocket.TextMessage, message, websocket.TextMessage, message},
+		{"deflate", []string{DeflateSubprotocol}, websocket.BinaryMessage, deflate(message), websocket.BinaryMessage, message},
+		{"text with deflate", []string{DeflateSubprotocol}, websocket.TextMessage, message, websocket.BinaryMessage, message},
+		{"binary without codec", nil, websocket.BinaryMessage, []byte("raw"), websocket.TextMessage, []byte("binary:raw")},
+	}
+	url := echoServer(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: test.subprotocols}
+			socket, _, err := dialer.Dial(url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer socket.Close()
+			if err := socket.WriteMessage(test.frameType, test.frame); err != nil {
+				t.Fatal(err)
+			}
+			socket.SetReadDeadline(time.Now().Add(5 * time.Second))
+			frameType, reply, err := socket.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frameType == websocket.BinaryMessage {
+				if reply, err = inflate(reply, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if frameType != test.wantType || !bytes.Equal(reply, test.want) {
+				t.Errorf("got frame type %d with %q, want %d with %q", frameType, reply, test.wantType, test.want)
+			}
+		})
+	}
+}
+
+func TestInflateLimit(t *testing.T) {
+	bomb := deflate(make([]byte, 1<<20))
+	if _, err := inflate(bomb, 64*1024); err != errMessageTooBig {
+		t.Errorf("inflate() = %v, want %v", err, errMessageTooBig)
+	}
+	if message, err := inflate(deflate([]byte("hello")), 64*1024); err != nil || string(message) != "hello" {
+		t.Errorf("inflate() = %q, %v, want hello", message, err)
+	}
+}
@@ -2,32 +2,120 @@ package websocket
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/chuckpreslar/emission"
 	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/metrics"
 	"github.com/gorilla/websocket"
 )
 
 const pingPeriod = 5 * time.Second
 const pongWait = 3 * pingPeriod // If no pong received within 3 ping cycles, connection is dead
 
+const keepaliveMessage = `{"type":"keepalive"}`
+
+// OverflowPolicy decides what happens when the send queue of a connection
+// is full.
+type OverflowPolicy string
+
+const (
+	// OverflowDropKeepalive drops the oldest queued keepalive to make room,
+	// and disconnects the client when there is none.
+	OverflowDropKeepalive OverflowPolicy = "drop_keepalive"
+	// OverflowDisconnect disconnects the client right away.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+func ParseOverflowPolicy(value string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(value); policy {
+	case OverflowDropKeepalive, OverflowDisconnect:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown overflow policy %q", value)
+}
+
+// ConnConfig bounds how much a slow client can hold up the server.
+type ConnConfig struct {
+	// QueueSize is how many messages may wait to be written.
+	QueueSize int
+	// WriteTimeout bounds writing a single message.
+	WriteTimeout time.Duration
+	Overflow     OverflowPolicy
+	// ReadLimit is the largest inbound message in bytes, 0 for no limit.
+	ReadLimit int64
+	// CompressionThreshold is the smallest message compressed when the
+	// client negotiated permessage-deflate, 0 compresses every message.
+	CompressionThreshold int
+}
+
+func DefaultConnConfig() ConnConfig {
+	return ConnConfig{
+		QueueSize:    256,
+		WriteTimeout: 10 * time.Second,
+		Overflow:     OverflowDropKeepalive,
+		ReadLimit:    64 * 1024,
+
+		CompressionThreshold: 1024,
+	}
+}
+
+type inboundMessage struct {
+	messageType int
+	data        []byte
+}
+
+type outboundMessage struct {
+	messageType int
+	data        []byte
+	keepalive   bool
+}
+
+// WebSocketConn writes from a goroutine of its own, so Send only queues the
+// message and never blocks on a slow client. Messages are emitted as
+// "message" and sent as text frames, or, when the client negotiated
+// DeflateSubprotocol, as compressed binary frames. Binary frames from other
+// clients have no codec and are emitted as "binary".
 type WebSocketConn struct {
 	emission.Emitter
 	socket    *websocket.Conn
+	config    ConnConfig
+	deflate   bool
 	mutex     *sync.Mutex
 	closed    bool
 	closeOnce sync.Once
+	queue     []outboundMessage
+	wake      chan struct{}
+	done      chan struct{}
+	doneOnce  sync.Once
+	// exited is closed once the writer has closed the socket.
+	exited chan struct{}
 }
 
-func NewWebSocketConn(socket *websocket.Conn) *WebSocketConn {
+func NewWebSocketConn(socket *websocket.Conn, config ConnConfig) *WebSocketConn {
 	var conn WebSocketConn
 	conn.Emitter = *emission.NewEmitter()
 	conn.socket = socket
+	conn.config = config
+	conn.deflate = socket.Subprotocol() == DeflateSubprotocol
 	conn.mutex = new(sync.Mutex)
 	conn.closed = false
+	conn.wake = make(chan struct{}, 1)
+	conn.done = make(chan struct{})
+	conn.exited = make(chan struct{})
+	if conn.config.QueueSize <= 0 {
+		conn.config.QueueSize = DefaultConnConfig().QueueSize
+	}
+	if conn.config.ReadLimit > 0 {
+		conn.socket.SetReadLimit(conn.config.ReadLimit)
+	}
+	if conn.deflate {
+		// Messages are compressed already
+		conn.socket.EnableWriteCompression(false)
+	}
 	conn.socket.SetCloseHandler(func(code int, text string) error {
 		logger.Warnf("%s [%d]", text, code)
 		conn.emitClose(code, text)
@@ -38,11 +126,12 @@ func NewWebSocketConn(socket *websocket.Conn) *WebSocketConn {
 		conn.socket.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
+	go conn.writeLoop()
 	return &conn
 }
 
 func (conn *WebSocketConn) ReadMessage() {
-	in := make(chan []byte)
+	in := make(chan inboundMessage)
 	stop := make(chan struct{})
 	pingTicker := time.NewTicker(pingPeriod)
 
@@ -51,40 +140,48 @@ func (conn *WebSocketConn) ReadMessage() {
 	c.SetReadDeadline(time.Now().Add(pongWait))
 	go func() {
 		for {
-			_, message, err := c.ReadMessage()
+			messageType, message, err := c.ReadMessage()
 			if err != nil {
 				logger.Warnf("Got error: %v", err)
 				if c, k := err.(*websocket.CloseError); k {
 					conn.emitClose(c.Code, c.Text)
 				} else if netErr, k := err.(net.Error); k && netErr.Timeout() {
+					metrics.ConnectionTimeouts.WithLabelValues("pong_timeout").Inc()
 					conn.emitClose(1006, "pong timeout")
 				} else if c, k := err.(*net.OpError); k {
 					conn.emitClose(1008, c.Error())
+				} else if err == websocket.ErrReadLimit {
+					conn.emitClose(websocket.CloseMessageTooBig, "message too big")
+				} else {
+					conn.emitClose(1006, err.Error())
 				}
 				close(stop)
 				break
 			}
-			in <- message
+			in <- inboundMessage{messageType: messageType, data: message}
 		}
 	}()
 
 	for {
 		select {
 		case _ = <-pingTicker.C:
-			// Send WebSocket ping frame for connection liveness detection
-			conn.mutex.Lock()
+			// Send WebSocket ping frame for connection liveness detection,
+			// WriteControl may be called concurrently with the writer
 			pingErr := conn.socket.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(5*time.Second))
-			conn.mutex.Unlock()
 			if pingErr != nil {
 				logger.Errorf("WebSocket ping failed: %v", pingErr)
+				metrics.ConnectionTimeouts.WithLabelValues("ping_failed").Inc()
 				pingTicker.Stop()
 				conn.emitClose(1006, "ping failed")
 				conn.socket.Close()
 				return
 			}
 			// Also send application-level keepalive for client awareness
-			if err := conn.Send(`{"type":"keepalive"}`); err != nil {
+			keepalive := conn.encode([]byte(keepaliveMessage))
+			keepalive.keepalive = true
+			if err := conn.enqueue(keepalive); err != nil {
 				logger.Errorf("Keepalive has failed")
+				metrics.ConnectionTimeouts.WithLabelValues("keepalive_failed").Inc()
 				pingTicker.Stop()
 				conn.emitClose(1006, "keepalive failed")
 				conn.socket.Close()
@@ -92,10 +189,12 @@ func (conn *WebSocketConn) ReadMessage() {
 			}
 		case message := <-in:
 			{
-				logger.Infof("Received data: %s", message)
-				conn.Emit("message", []byte(message))
+				logger.Infof("Received data: %d bytes", len(message.data))
+				conn.dispatch(message)
 			}
 		case <-stop:
+			pingTicker.Stop()
+			conn.stopWriter()
 			return
 		}
 	}
@@ -103,7 +202,10 @@ func (conn *WebSocketConn) ReadMessage() {
 
 func (conn *WebSocketConn) emitClose(code int, text string) {
 	conn.closeOnce.Do(func() {
+		conn.mutex.Lock()
 		conn.closed = true
+		conn.mutex.Unlock()
+		conn.stopWriter()
 		conn.Emit("close", code, text)
 	})
 }
@@ -112,26 +214,189 @@ func (conn *WebSocketConn) emitClose(code int, text string) {
 * Send |message| to the connection.
  */
 func (conn *WebSocketConn) Send(message string) error {
-	logger.Infof("Send data: %s", message)
+	// Not the payload itself, which may hold TURN credentials.
+	logger.Infof("Send data: %d bytes", len(message))
+	return conn.enqueue(conn.encode([]byte(message)))
+}
+
+// encode frames |message| in the codec of the connection.
+func (conn *WebSocketConn) encode(message []byte) outboundMessage {
+	if conn.deflate {
+		return outboundMessage{messageType: websocket.BinaryMessage, data: deflate(message)}
+	}
+	return outboundMessage{messageType: websocket.TextMessage, data: message}
+}
+
+// dispatch emits |message| decoded with the codec of the connection.
+func (conn *WebSocketConn) dispatch(message inboundMessage) {
+	if message.messageType != websocket.BinaryMessage {
+		conn.Emit("message", message.data)
+		return
+	}
+	if !conn.deflate {
+		conn.Emit("binary", message.data)
+		return
+	}
+	data, err := inflate(message.data, conn.config.ReadLimit)
+	if err == errMessageTooBig {
+		conn.disconnect(websocket.CloseMessageTooBig, "message too big")
+		return
+	}
+	if err != nil {
+		logger.Warnf("Dropping message from %s: %v", conn.socket.RemoteAddr(), err)
+		return
+	}
+	conn.Emit("message", data)
+}
+
+// enqueue hands |message| to the writer, applying the overflow policy when
+// the queue is full.
+func (conn *WebSocketConn) enqueue(message outboundMessage) error {
 	conn.mutex.Lock()
-	defer conn.mutex.Unlock()
 	if conn.closed {
+		conn.mutex.Unlock()
 		return errors.New("websocket: write closed")
 	}
-	return conn.socket.WriteMessage(websocket.TextMessage, []byte(message))
+	if len(conn.queue) >= conn.config.QueueSize && !conn.makeRoomLocked(message) {
+		conn.mutex.Unlock()
+		if message.keepalive {
+			return nil
+		}
+		logger.Warnf("Send queue of %s full, disconnecting slow client", conn.socket.RemoteAddr())
+		metrics.WebSocketQueueOverflows.WithLabelValues("disconnect").Inc()
+		// Close handlers may take locks the caller is holding
+		go conn.disconnect(websocket.ClosePolicyViolation, "slow consumer")
+		return errors.New("websocket: send queue full")
+	}
+	conn.queue = append(conn.queue, message)
+	metrics.WebSocketQueuedMessages.Inc()
+	conn.mutex.Unlock()
+
+	select {
+	case conn.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// makeRoomLocked frees a slot for |message| if the overflow policy allows.
+func (conn *WebSocketConn) makeRoomLocked(message outboundMessage) bool {
+	if conn.config.Overflow != OverflowDropKeepalive {
+		return false
+	}
+	if message.keepalive {
+		// Nothing to gain from queueing another keepalive
+		metrics.WebSocketQueueOverflows.WithLabelValues("drop_keepalive").Inc()
+		return false
+	}
+	for i, queued := range conn.queue {
+		if queued.keepalive {
+			conn.queue = append(conn.queue[:i], conn.queue[i+1:]...)
+			metrics.WebSocketQueuedMessages.Dec()
+			metrics.WebSocketQueueOverflows.WithLabelValues("drop_keepalive").Inc()
+			return true
+		}
+	}
+	return false
+}
+
+func (conn *WebSocketConn) dequeue() (outboundMessage, bool) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if len(conn.queue) == 0 {
+		return outboundMessage{}, false
+	}
+	message := conn.queue[0]
+	conn.queue[0] = outboundMessage{}
+	conn.queue = conn.queue[1:]
+	metrics.WebSocketQueuedMessages.Dec()
+	return message, true
+}
+
+// writeLoop writes the queued messages until the connection goes away or,
+// once Close was called, the queue is drained. It owns closing the socket.
+func (conn *WebSocketConn) writeLoop() {
+	defer func() {
+		conn.socket.Close()
+		conn.mutex.Lock()
+		metrics.WebSocketQueuedMessages.Sub(float64(len(conn.queue)))
+		conn.queue = nil
+		conn.mutex.Unlock()
+		close(conn.exited)
+	}()
+	for {
+		select {
+		case <-conn.wake:
+		case <-conn.done:
+			return
+		}
+		for {
+			message, ok := conn.dequeue()
+			if !ok {
+				break
+			}
+			if conn.config.WriteTimeout > 0 {
+				conn.socket.SetWriteDeadline(time.Now().Add(conn.config.WriteTimeout))
+			}
+			if conn.config.CompressionThreshold > 0 && !conn.deflate {
+				// No-op unless permessage-deflate was negotiated
+				conn.socket.EnableWriteCompression(len(message.data) >= conn.config.CompressionThreshold)
+			}
+			if err := conn.socket.WriteMessage(message.messageType, message.data); err != nil {
+				logger.Warnf("WebSocket write to %s failed: %v", conn.socket.RemoteAddr(), err)
+				metrics.ConnectionTimeouts.WithLabelValues("write_failed").Inc()
+				conn.emitClose(1006, "write failed")
+				return
+			}
+		}
+		conn.mutex.Lock()
+		closing := conn.closed
+		conn.mutex.Unlock()
+		if closing {
+			// Say goodbye so the client sees a clean close
+			var deadline time.Time
+			if conn.config.WriteTimeout > 0 {
+				deadline = time.Now().Add(conn.config.WriteTimeout)
+			}
+			message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			conn.socket.WriteControl(websocket.CloseMessage, message, deadline)
+			return
+		}
+	}
+}
+
+func (conn *WebSocketConn) stopWriter() {
+	conn.doneOnce.Do(func() {
+		close(conn.done)
+	})
+}
+
+// disconnect drops a client the server gave up on.
+func (conn *WebSocketConn) disconnect(code int, text string) {
+	conn.emitClose(code, text)
+	conn.socket.Close()
 }
 
 /*
-* Close conn.
+* Close conn once the messages already sent are written, see Done.
  */
 func (conn *WebSocketConn) Close() {
 	conn.mutex.Lock()
 	defer conn.mutex.Unlock()
 	if conn.closed == false {
-		logger.Infof("Close ws conn now : ", conn)
-		conn.socket.Close()
+		logger.Infof("Close ws conn now : %s", conn.socket.RemoteAddr())
 		conn.closed = true
+		select {
+		case conn.wake <- struct{}{}:
+		default:
+		}
 	} else {
-		logger.Warnf("Transport already closed :", conn)
+		logger.Warnf("Transport already closed : %s", conn.socket.RemoteAddr())
 	}
 }
+
+// Done is closed once the writer has flushed what Close left queued, or
+// given up on the connection, and closed the socket.
+func (conn *WebSocketConn) Done() <-chan struct{} {
+	return conn.exited
+}
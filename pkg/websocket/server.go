@@ -1,21 +1,62 @@
 package websocket
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
 	"net/http"
 	"strconv"
 
 	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/logger"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/metrics"
+	"github.com/flutter-webrtc/flutter-webrtc-server/pkg/util"
 	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type WebSocketServerConfig struct {
-	Host           string
-	Port           int
-	CertFile       string
-	KeyFile        string
+	Host     string
+	Port     int
+	CertFile string
+	KeyFile  string
+	// PlainHTTP serves without TLS, e.g. behind a TLS terminating load
+	// balancer.
+	PlainHTTP bool
+	// ACME obtains and renews the certificate of Domain automatically
+	// instead of reading CertFile and KeyFile. Certificates are kept in
+	// ACMECacheDir; ACMEHTTPPort answers HTTP-01 challenges, with 0 only
+	// TLS-ALPN-01 on port 443 is possible.
+	ACME           bool
+	Domain         string
+	ACMEEmail      string
+	ACMECacheDir   string
+	ACMEHTTPPort   int
 	HTMLRoot       string
 	WebSocketPath  string
 	TurnServerPath string
+	AdminPath      string
+	// MetricsPath serves Prometheus metrics, unauthenticated; empty, the
+	// default, disables it.
+	MetricsPath string
+	Conn        ConnConfig
+	// Compression accepts permessage-deflate when clients offer it, see
+	// ConnConfig.CompressionThreshold.
+	Compression bool
+	// BinaryCodec accepts DeflateSubprotocol when clients offer it.
+	BinaryCodec bool
+	// AllowedOrigins may open WebSocket connections from browsers, see
+	// originAllowed; empty allows any origin.
+	AllowedOrigins []string
+	// MaxConnections and MaxConnectionsPerIP cap concurrent connections,
+	// HandshakeRateLimit the handshakes per client IP and minute. 0 disables.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	HandshakeRateLimit  int
+	// TrustedProxies are the load balancers, as CIDRs or addresses, whose
+	// X-Forwarded-For header names the client. Requests from them are seen
+	// by every handler, and the per-IP limits, with the client address.
+	TrustedProxies []string
 }
 
 func DefaultConfig() WebSocketServerConfig {
@@ -25,39 +66,86 @@ func DefaultConfig() WebSocketServerConfig {
 		HTMLRoot:       "web",
 		WebSocketPath:  "/ws",
 		TurnServerPath: "/api/turn",
+		AdminPath:      "/api/admin",
+		Conn:           DefaultConnConfig(),
+		Compression:    true,
+		BinaryCodec:    true,
+		ACMECacheDir:   "configs/acme",
+		ACMEHTTPPort:   80,
 	}
 }
 
 type WebSocketServer struct {
 	handleWebSocket  func(ws *WebSocketConn, request *http.Request)
 	handleTurnServer func(writer http.ResponseWriter, request *http.Request)
+	handleAdmin      func(writer http.ResponseWriter, request *http.Request)
 	// Websocket upgrader
-	upgrader websocket.Upgrader
+	upgrader   websocket.Upgrader
+	mux        *http.ServeMux
+	httpServer *http.Server
+	config     WebSocketServerConfig
+	admission  *admission
+	// trustedProxies is the parsed WebSocketServerConfig.TrustedProxies.
+	trustedProxies []*net.IPNet
+	// acmeServer answers ACME HTTP-01 challenges.
+	acmeServer   *http.Server
+	certificates *util.CertReloader
 }
 
 func NewWebSocketServer(
+	config WebSocketServerConfig,
 	wsHandler func(ws *WebSocketConn, request *http.Request),
-	turnServerHandler func(writer http.ResponseWriter, request *http.Request)) *WebSocketServer {
+	turnServerHandler func(writer http.ResponseWriter, request *http.Request),
+	adminHandler func(writer http.ResponseWriter, request *http.Request)) *WebSocketServer {
 	var server = &WebSocketServer{
 		handleWebSocket:  wsHandler,
 		handleTurnServer: turnServerHandler,
+		handleAdmin:      adminHandler,
+		mux:              http.NewServeMux(),
+		config:           config,
+		admission:        newAdmission(config),
+	}
+	var err error
+	if server.trustedProxies, err = util.ParseNetworks(config.TrustedProxies); err != nil {
+		logger.Panicf("Invalid trusted proxy: %v", err)
 	}
 	server.upgrader = websocket.Upgrader{
+		// Origins are checked by the admission control before upgrading
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
+		EnableCompression: config.Compression,
+	}
+	if config.BinaryCodec {
+		server.upgrader.Subprotocols = []string{DeflateSubprotocol}
+	}
+
+	server.mux.HandleFunc(config.WebSocketPath, server.handleWebSocketRequest)
+	server.mux.HandleFunc(config.TurnServerPath, server.handleTurnServerRequest)
+	server.mux.Handle(config.AdminPath+"/", http.StripPrefix(config.AdminPath, http.HandlerFunc(server.handleAdminRequest)))
+	if len(config.MetricsPath) > 0 {
+		server.mux.Handle(config.MetricsPath, metrics.Handler())
+	}
+	if len(config.HTMLRoot) > 0 {
+		server.mux.Handle("/", http.FileServer(http.Dir(config.HTMLRoot)))
 	}
 	return server
 }
 
 func (server *WebSocketServer) handleWebSocketRequest(writer http.ResponseWriter, request *http.Request) {
+	if !server.admission.admit(writer, request, server.config.AllowedOrigins) {
+		return
+	}
+	defer server.admission.release(request)
+
 	responseHeader := http.Header{}
-	//responseHeader.Add("Sec-WebSocket-Protocol", "protoo")
 	socket, err := server.upgrader.Upgrade(writer, request, responseHeader)
 	if err != nil {
-		logger.Panicf("%v", err)
+		// The upgrader already answered the handshake
+		logger.Warnf("WebSocket upgrade from %s failed: %v", request.RemoteAddr, err)
+		return
 	}
-	wsTransport := NewWebSocketConn(socket)
+	wsTransport := NewWebSocketConn(socket, server.config.Conn)
 	server.handleWebSocket(wsTransport, request)
 	wsTransport.ReadMessage()
 }
@@ -66,13 +154,131 @@ func (server *WebSocketServer) handleTurnServerRequest(writer http.ResponseWrite
 	server.handleTurnServer(writer, request)
 }
 
-// Bind .
-func (server *WebSocketServer) Bind(cfg WebSocketServerConfig) {
-	// Websocket handle func
-	http.HandleFunc(cfg.WebSocketPath, server.handleWebSocketRequest)
-	http.HandleFunc(cfg.TurnServerPath, server.handleTurnServerRequest)
-	http.Handle("/", http.FileServer(http.Dir(cfg.HTMLRoot)))
-	logger.Infof("Flutter WebRTC Server listening on: %s:%d", cfg.Host, cfg.Port)
-	// http.ListenAndServe(cfg.Host+":"+strconv.Itoa(cfg.Port), nil)
-	panic(http.ListenAndServeTLS(cfg.Host+":"+strconv.Itoa(cfg.Port), cfg.CertFile, cfg.KeyFile, nil))
+func (server *WebSocketServer) handleAdminRequest(writer http.ResponseWriter, request *http.Request) {
+	server.handleAdmin(writer, request)
+}
+
+// Handler serves the WebSocket, TURN credentials, admin, metrics and static
+// endpoints, to be mounted in another server or used with httptest.
+func (server *WebSocketServer) Handler() http.Handler {
+	if len(server.trustedProxies) == 0 {
+		return server.mux
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, port, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			server.mux.ServeHTTP(writer, request)
+			return
+		}
+		// Leave the caller's request untouched
+		forwarded := *request
+		forwarded.RemoteAddr = net.JoinHostPort(util.ClientIP(request, server.trustedProxies), port)
+		server.mux.ServeHTTP(writer, &forwarded)
+	})
+}
+
+// Start listens on the configured address and serves in the background
+// until Shutdown is called or |ctx| is done. Listen errors are returned.
+func (server *WebSocketServer) Start(ctx context.Context) error {
+	cfg := server.config
+	address := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port))
+	server.httpServer = &http.Server{
+		Addr:        address,
+		Handler:     server.Handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	if !cfg.PlainHTTP {
+		tlsConfig, err := server.tlsConfig(ctx)
+		if err != nil {
+			return err
+		}
+		server.httpServer.TLSConfig = tlsConfig
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		server.closeTLS()
+		return err
+	}
+
+	httpServer := server.httpServer
+	go func() {
+		var err error
+		if cfg.PlainHTTP {
+			logger.Infof("Flutter WebRTC Server listening on: http://%s", address)
+			err = httpServer.Serve(listener)
+		} else {
+			logger.Infof("Flutter WebRTC Server listening on: https://%s", address)
+			err = httpServer.ServeTLS(listener, "", "")
+		}
+		if err != http.ErrServerClosed {
+			logger.Panicf("%v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+		server.closeTLS()
+	}()
+	return nil
+}
+
+// tlsConfig serves the ACME certificate of the domain, or the configured
+// files reloaded whenever they change.
+func (server *WebSocketServer) tlsConfig(ctx context.Context) (*tls.Config, error) {
+	cfg := server.config
+	if !cfg.ACME {
+		certificates, err := util.NewCertReloader(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.certificates = certificates
+		return &tls.Config{GetCertificate: certificates.GetCertificate}, nil
+	}
+
+	if len(cfg.Domain) == 0 {
+		return nil, errors.New("ACME requires a domain")
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Domain),
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		Email:      cfg.ACMEEmail,
+	}
+	if cfg.ACMEHTTPPort > 0 {
+		address := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.ACMEHTTPPort))
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		server.acmeServer = &http.Server{Addr: address, Handler: manager.HTTPHandler(nil)}
+		acmeServer := server.acmeServer
+		go func() {
+			if err := acmeServer.Serve(listener); err != http.ErrServerClosed {
+				logger.Errorf("ACME challenge server: %v", err)
+			}
+		}()
+		logger.Infof("ACME HTTP-01 challenges for %s served on: http://%s", cfg.Domain, address)
+	}
+	return manager.TLSConfig(), nil
+}
+
+// closeTLS stops the ACME challenge server and the certificate reloader,
+// on Shutdown or when the context of Start is done.
+func (server *WebSocketServer) closeTLS() {
+	if server.acmeServer != nil {
+		server.acmeServer.Close()
+	}
+	if server.certificates != nil {
+		server.certificates.Close()
+	}
+}
+
+// Shutdown stops accepting new connections. Upgraded WebSocket connections
+// are hijacked and left to their handler to close.
+func (server *WebSocketServer) Shutdown(ctx context.Context) error {
+	if server.httpServer == nil {
+		return nil
+	}
+	server.closeTLS()
+	return server.httpServer.Shutdown(ctx)
 }
@@ -0,0 +1,29 @@
+package websocket
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandlerForwardedClientIP(t *testing.T) {
+	config := DefaultConfig()
+	config.HTMLRoot = ""
+	config.TrustedProxies = []string{"10.0.0.0/8"}
+	var seen string
+	server := NewWebSocketServer(config, nil, func(writer http.ResponseWriter, request *http.Request) {
+		seen = request.RemoteAddr
+	}, nil)
+
+	request := httptest.NewRequest(http.MethodGet, config.TurnServerPath, nil)
+	request.RemoteAddr = "10.0.0.2:5000"
+	request.Header.Set("X-Forwarded-For", "203.0.113.7")
+	server.Handler().ServeHTTP(httptest.NewRecorder(), request)
+
+	if seen != "203.0.113.7:5000" {
+		t.Errorf("handler saw %s, want 203.0.113.7:5000", seen)
+	}
+	if request.RemoteAddr != "10.0.0.2:5000" {
+		t.Errorf("caller's request changed to %s", request.RemoteAddr)
+	}
+}